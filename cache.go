@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// The API accepts at most this many cache_control breakpoints per request
+const maxCacheBreakpoints = 4
+
+// cacheBreakpoint marks the end of a prefix the API should cache
+var cacheBreakpoint = anthropic.CacheControlEphemeralParam{Type: "ephemeral"}
+
+// addCacheBreakpoints marks the cacheable prefixes of a request: the tool
+// definitions, the system prompt and a rolling point at the end of the
+// conversation. A second rolling point on the previous user message lets the
+// next request read what this one wrote even as the conversation grows.
+// Tools and system are modified in place; the messages are copied so the
+// breakpoints don't end up in the stored conversation. It returns the
+// messages to send and the number of breakpoints used.
+func addCacheBreakpoints(tools []anthropic.ToolUnionParam, system []anthropic.TextBlockParam, messages []anthropic.MessageParam) ([]anthropic.MessageParam, int) {
+	breakpoints := 0
+	if len(tools) > 0 && tools[len(tools)-1].OfTool != nil {
+		tools[len(tools)-1].OfTool.CacheControl = cacheBreakpoint
+		breakpoints++
+	}
+	if len(system) > 0 {
+		system[len(system)-1].CacheControl = cacheBreakpoint
+		breakpoints++
+	}
+
+	messages = append([]anthropic.MessageParam{}, messages...)
+	mark := func(i int) {
+		if content, ok := withCacheBreakpoint(messages[i].Content); ok && breakpoints < maxCacheBreakpoints {
+			messages[i].Content = content
+			breakpoints++
+		}
+	}
+	last := len(messages) - 1
+	if last < 0 {
+		return messages, breakpoints
+	}
+	mark(last)
+	for i := last - 1; i >= 0; i-- {
+		if messages[i].Role == anthropic.MessageParamRoleUser {
+			mark(i)
+			break
+		}
+	}
+	return messages, breakpoints
+}
+
+// withCacheBreakpoint returns a copy of the content with a breakpoint on the
+// last block that can carry one. Thinking blocks can't.
+func withCacheBreakpoint(content []anthropic.ContentBlockParamUnion) ([]anthropic.ContentBlockParamUnion, bool) {
+	for i := len(content) - 1; i >= 0; i-- {
+		block, ok := copyWithCacheControl(content[i])
+		if !ok {
+			continue
+		}
+		copied := append([]anthropic.ContentBlockParamUnion{}, content...)
+		copied[i] = block
+		return copied, true
+	}
+	return content, false
+}
+
+// copyWithCacheControl copies a block and sets its cache_control. The block
+// variants are pointers, so the variant is copied too.
+func copyWithCacheControl(block anthropic.ContentBlockParamUnion) (anthropic.ContentBlockParamUnion, bool) {
+	switch {
+	case block.OfRequestTextBlock != nil:
+		text := *block.OfRequestTextBlock
+		text.CacheControl = cacheBreakpoint
+		return anthropic.ContentBlockParamUnion{OfRequestTextBlock: &text}, true
+	case block.OfRequestImageBlock != nil:
+		image := *block.OfRequestImageBlock
+		image.CacheControl = cacheBreakpoint
+		return anthropic.ContentBlockParamUnion{OfRequestImageBlock: &image}, true
+	case block.OfRequestToolUseBlock != nil:
+		toolUse := *block.OfRequestToolUseBlock
+		toolUse.CacheControl = cacheBreakpoint
+		return anthropic.ContentBlockParamUnion{OfRequestToolUseBlock: &toolUse}, true
+	case block.OfRequestToolResultBlock != nil:
+		toolResult := *block.OfRequestToolResultBlock
+		toolResult.CacheControl = cacheBreakpoint
+		return anthropic.ContentBlockParamUnion{OfRequestToolResultBlock: &toolResult}, true
+	case block.OfRequestDocumentBlock != nil:
+		document := *block.OfRequestDocumentBlock
+		document.CacheControl = cacheBreakpoint
+		return anthropic.ContentBlockParamUnion{OfRequestDocumentBlock: &document}, true
+	}
+	return block, false
+}
+
+// printCacheUsage shows how much of a request's input came from the cache
+func printCacheUsage(out io.Writer, usage anthropic.Usage) {
+	total := usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens
+	hitRate := 0.0
+	if total > 0 {
+		hitRate = float64(usage.CacheReadInputTokens) / float64(total) * 100
+	}
+	fmt.Fprintf(out, "\u001b[96mdebug\u001b[0m: Cache read %d, cache write %d, uncached %d input tokens (%.0f%% hit rate)\n",
+		usage.CacheReadInputTokens, usage.CacheCreationInputTokens, usage.InputTokens, hitRate)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Request headers kept in recordings. Everything else, in particular the API
+// key headers, is left out.
+var recordedRequestHeaders = []string{"Content-Type", "Anthropic-Version", "Anthropic-Beta"}
+
+// Response headers kept in recordings
+var recordedResponseHeaders = []string{"Content-Type", "Retry-After", "Retry-After-Ms"}
+
+// Environment variables holding secrets that are scrubbed from recordings
+var secretEnvVars = []string{"ANTHROPIC_API_KEY", "ANTHROPIC_AUTH_TOKEN", "OPENAI_API_KEY"}
+
+// Request headers carrying credentials. They aren't recorded, and their
+// values are also scrubbed wherever else they turn up.
+var secretHeaders = []string{"X-Api-Key", "Authorization"}
+
+// Cassette is a recording of the HTTP exchanges with a model API, used to
+// replay sessions without a network connection or API key.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a single recorded request and its response
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is kept as JSON so that cassettes are readable. Bodies that
+	// aren't JSON are stored as a string.
+	Body json.RawMessage `json:"body"`
+}
+
+type RecordedResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+}
+
+// LoadCassette reads a cassette file
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %w", path, err)
+	}
+	return &cassette, nil
+}
+
+// Save writes the cassette to path
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Recorder is an http.RoundTripper that passes requests on and records every
+// exchange into a cassette file, which is rewritten as each response
+// completes so that nothing is lost if the program exits.
+type Recorder struct {
+	path      string
+	transport http.RoundTripper
+	// out receives warnings about cassettes that can't be saved
+	out io.Writer
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder creates a recorder writing to the cassette at path
+func NewRecorder(path string, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{path: path, transport: transport, out: os.Stdout}
+}
+
+func (r *Recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+	secrets := requestSecrets(request.Header)
+	response, err := r.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	interaction := Interaction{
+		Request: RecordedRequest{
+			Method:  request.Method,
+			Path:    request.URL.RequestURI(),
+			Headers: pickHeaders(request.Header, recordedRequestHeaders),
+			Body:    requestBodyJSON(scrubSecrets(body, secrets)),
+		},
+		Response: RecordedResponse{
+			Status:  response.StatusCode,
+			Headers: pickHeaders(response.Header, recordedResponseHeaders),
+		},
+	}
+	// Capture the body as the caller streams it, recording once it's done
+	response.Body = &recordingBody{
+		ReadCloser: response.Body,
+		done: func(body []byte) {
+			interaction.Response.Body = scrubSecrets(string(body), secrets)
+			r.record(interaction)
+		},
+	}
+	return response, nil
+}
+
+func (r *Recorder) record(interaction Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	if err := r.cassette.Save(r.path); err != nil {
+		fmt.Fprintf(r.out, "Warning: Failed to save cassette: %v\n", err)
+	}
+}
+
+// recordingBody copies everything read from a response body and hands it to
+// done when the body is closed
+type recordingBody struct {
+	io.ReadCloser
+	buffer bytes.Buffer
+	once   sync.Once
+	done   func([]byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buffer.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.buffer.Bytes()) })
+	return err
+}
+
+// CassetteMismatchError is returned for a request the cassette can't answer.
+// Replaying it again won't help, so it isn't retried.
+type CassetteMismatchError struct {
+	Message string
+}
+
+func (e *CassetteMismatchError) Error() string {
+	return e.Message
+}
+
+func cassetteMismatch(format string, args ...any) error {
+	return &CassetteMismatchError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Replayer is an http.RoundTripper that serves the interactions of a cassette
+// in order. A request must match the recording in its messages and the names
+// of its tools, or it fails with a diff against the recorded request. Other
+// differences, such as reworded tool descriptions or changed schemas, don't
+// affect the recorded response and are only collected as drift.
+type Replayer struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	next     int
+	drift    []string
+}
+
+// NewReplayer creates a replayer for the cassette at path
+func NewReplayer(path string) (*Replayer, error) {
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Replayer{cassette: cassette}, nil
+}
+
+func (r *Replayer) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next >= len(r.cassette.Interactions) {
+		return nil, cassetteMismatch("cassette has no more interactions, got an extra request to %s %s", request.Method, request.URL.RequestURI())
+	}
+	interaction := r.cassette.Interactions[r.next]
+	recorded := interaction.Request
+	if recorded.Method != request.Method || recorded.Path != request.URL.RequestURI() {
+		return nil, cassetteMismatch("request %d doesn't match the cassette: recorded %s %s, got %s %s",
+			r.next+1, recorded.Method, recorded.Path, request.Method, request.URL.RequestURI())
+	}
+	actual := requestBodyJSON(scrubSecrets(body, requestSecrets(request.Header)))
+	if diff := diffBodies(requestEssentials(recorded.Body), requestEssentials(actual)); diff != "" {
+		return nil, cassetteMismatch("request %d body doesn't match the cassette (- recorded, + actual):\n%s", r.next+1, diff)
+	}
+	if diff := diffBodies(recorded.Body, actual); diff != "" {
+		r.drift = append(r.drift, fmt.Sprintf("request %d differs from the cassette outside its messages and tool names (- recorded, + actual):\n%s", r.next+1, diff))
+	}
+	r.next++
+
+	header := http.Header{}
+	for name, value := range interaction.Response.Headers {
+		header.Set(name, value)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Response.Status, http.StatusText(interaction.Response.Status)),
+		StatusCode:    interaction.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(interaction.Response.Body)),
+		ContentLength: int64(len(interaction.Response.Body)),
+		Request:       request,
+	}, nil
+}
+
+// Remaining reports how many recorded interactions haven't been replayed
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.cassette.Interactions) - r.next
+}
+
+// Drift describes the replayed requests that differed from the recording in
+// ways that don't change its meaning. A cassette with drift still replays, but
+// re-recording it brings it up to date.
+func (r *Replayer) Drift() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.drift)
+}
+
+// readRequestBody reads a request's body and puts it back for sending
+func readRequestBody(request *http.Request) (string, error) {
+	if request.Body == nil {
+		return "", nil
+	}
+	body, err := io.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to read request body: %w", err)
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	return string(body), nil
+}
+
+// requestBodyJSON returns the body as stored in a cassette
+func requestBodyJSON(body string) json.RawMessage {
+	if json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	encoded, _ := json.Marshal(body)
+	return encoded
+}
+
+func pickHeaders(header http.Header, names []string) map[string]string {
+	picked := map[string]string{}
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			picked[name] = value
+		}
+	}
+	return picked
+}
+
+// secret is a value that must not be written to a cassette, and the name it
+// is replaced with
+type secret struct {
+	name  string
+	value string
+}
+
+// requestSecrets returns the values of the API key environment variables and
+// the credentials sent in the request's headers
+func requestSecrets(header http.Header) []secret {
+	secrets := []secret{}
+	for _, name := range secretEnvVars {
+		secrets = append(secrets, secret{name, os.Getenv(name)})
+	}
+	for _, name := range secretHeaders {
+		value := header.Get(name)
+		secrets = append(secrets, secret{name, strings.TrimPrefix(value, "Bearer ")})
+	}
+	return secrets
+}
+
+// scrubSecrets replaces the secrets in text with their names. Values too short
+// to be real keys are left alone, so that they don't mangle unrelated text.
+func scrubSecrets(text string, secrets []secret) string {
+	for _, secret := range secrets {
+		if len(secret.value) >= 8 {
+			text = strings.ReplaceAll(text, secret.value, "[REDACTED "+secret.name+"]")
+		}
+	}
+	return text
+}
+
+// requestEssentials picks the parts of a request body that decide what the
+// model answers: the messages and the names of the tools offered
+func requestEssentials(body json.RawMessage) json.RawMessage {
+	var request struct {
+		Messages json.RawMessage `json:"messages"`
+		Tools    []struct {
+			Name string `json:"name"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return body
+	}
+	names := []string{}
+	for _, tool := range request.Tools {
+		names = append(names, tool.Name)
+	}
+	essentials, err := json.Marshal(map[string]any{"messages": request.Messages, "tools": names})
+	if err != nil {
+		return body
+	}
+	return essentials
+}
+
+// diffBodies compares two request bodies line by line, after formatting them
+// the same way. It returns an empty string if they match.
+func diffBodies(recorded, actual json.RawMessage) string {
+	a, b := formatBody(recorded), formatBody(actual)
+	if a == b {
+		return ""
+	}
+	return lineDiff(strings.Split(a, "\n"), strings.Split(b, "\n"))
+}
+
+// formatBody indents JSON so that a diff points at the field that changed.
+// Keys are sorted, so formatting doesn't depend on the encoder's field order.
+func formatBody(body json.RawMessage) string {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return string(body)
+	}
+	formatted, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return string(body)
+	}
+	return string(formatted)
+}
+
+// Lines of unchanged context shown around each change in a diff
+const diffContext = 3
+
+// lineDiff renders the differences between two lists of lines, based on
+// their longest common subsequence
+func lineDiff(a, b []string) string {
+	// common[i][j] is the length of the LCS of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	lines := []line{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i, j = i+1, j+1
+		case j < len(b) && (i == len(a) || common[i][j+1] >= common[i+1][j]):
+			lines = append(lines, line{'+', b[j]})
+			j++
+		default:
+			lines = append(lines, line{'-', a[i]})
+			i++
+		}
+	}
+
+	// Only show changed lines and the context around them
+	var diff strings.Builder
+	lastShown := -1
+	for index, current := range lines {
+		near := false
+		for k := max(0, index-diffContext); k <= min(len(lines)-1, index+diffContext); k++ {
+			if lines[k].op != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if lastShown >= 0 && index > lastShown+1 {
+			diff.WriteString("  ...\n")
+		}
+		fmt.Fprintf(&diff, "%c %s\n", current.op, current.text)
+		lastShown = index
+	}
+	return strings.TrimRight(diff.String(), "\n")
+}
+
+// cassetteTransport returns the transport for the -record or -replay flags,
+// or nil if neither is set. A recorder's warnings are written to out.
+func cassetteTransport(out io.Writer, recordPath, replayPath string) (http.RoundTripper, error) {
+	switch {
+	case recordPath != "" && replayPath != "":
+		return nil, errors.New("-record and -replay can't be used together")
+	case recordPath != "":
+		recorder := NewRecorder(recordPath, nil)
+		recorder.out = out
+		return recorder, nil
+	case replayPath != "":
+		return NewReplayer(replayPath)
+	}
+	return nil, nil
+}
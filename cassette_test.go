@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// anthropicStandIn serves the messages endpoint the way the Anthropic API
+// does, streaming the scripted turns in order, so that sessions can be
+// recorded into cassettes without an API key
+func anthropicStandIn(t *testing.T, turns ...Turn) *httptest.Server {
+	var mu sync.Mutex
+	next := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/v1/messages" || next >= len(turns) {
+			t.Errorf("unexpected request %d to %s, the script has %d turns", next+1, r.URL.Path, len(turns))
+			http.Error(w, `{"type":"error","error":{"type":"invalid_request_error","message":"unexpected request"}}`, http.StatusBadRequest)
+			return
+		}
+		next++
+		events, err := scriptedEvents(next, turns[next-1])
+		if err != nil {
+			t.Errorf("turn %d: %v", next, err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.RawJSON())
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// cassetteAgent creates an agent that talks to the Anthropic API at baseURL
+// through transport and whose user messages come from inputs
+func cassetteAgent(t *testing.T, baseURL string, transport http.RoundTripper, inputs []string) *Agent {
+	t.Helper()
+	config := DefaultConfig()
+	config.BaseURL = baseURL
+	provider, err := NewProvider(config, &http.Client{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	getUserMessage := func(string) (string, bool) {
+		if len(inputs) == 0 {
+			return "", false
+		}
+		input := inputs[0]
+		inputs = inputs[1:]
+		return input, true
+	}
+	tools := []ToolDefinition{ReadFileDefinition, ListFilesDefinition, EditFileDefinition}
+	agent := NewAgent(provider, getUserMessage, tools, config, "You are a coding agent working in a test directory. Be brief.")
+	agent.streamHandler = nil
+	agent.out = io.Discard
+	return agent
+}
+
+func TestReplaySessionWithTools(t *testing.T) {
+	inputs := []string{"Make the greeting in greeting.txt uppercase", "What files are in the directory?"}
+	files := map[string]string{"greeting.txt": "hello world\n"}
+	server := anthropicStandIn(t,
+		Turn{Calls: []Call{{"read_file", map[string]any{"path": "greeting.txt"}}}},
+		Turn{Calls: []Call{{"edit_file", map[string]any{"path": "greeting.txt", "old_str": "hello world", "new_str": "HELLO WORLD"}}}},
+		Turn{Text: "greeting.txt now says HELLO WORLD."},
+		Turn{Calls: []Call{{"list_files", map[string]any{}}}},
+		Turn{Text: "The directory only contains greeting.txt."},
+	)
+
+	// Record the session against the stand-in
+	cassette := filepath.Join(t.TempDir(), "edit_greeting.json")
+	t.Setenv("ANTHROPIC_API_KEY", "sk-ant-REDACTED")
+	useWorkspace(t, files)
+	if err := cassetteAgent(t, server.URL, NewRecorder(cassette, nil), inputs).Run(context.Background()); err != nil {
+		t.Fatalf("recording failed: %v", err)
+	}
+	server.Close()
+
+	// Replay it in a fresh workspace, with the tools running for real
+	t.Setenv("ANTHROPIC_API_KEY", "replayed")
+	useWorkspace(t, files)
+	replayer, err := NewReplayer(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := cassetteAgent(t, server.URL, replayer, inputs)
+	if err := agent.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	assertFile(t, "greeting.txt", "HELLO WORLD\n")
+	if replayer.Remaining() != 0 {
+		t.Errorf("%d recorded interactions were not replayed", replayer.Remaining())
+	}
+	if drift := replayer.Drift(); len(drift) != 0 {
+		t.Errorf("the replayed requests drifted from the recording:\n%s", strings.Join(drift, "\n"))
+	}
+	// The whole conversation, tool results included, was replayed
+	if got := describeMessages(agent.conversation); len(got) != 10 || got[9] != "assistant: The directory only contains greeting.txt." {
+		t.Errorf("replayed conversation = %q", got)
+	}
+}
+
+// messagesRequest returns a request body like the ones the agent sends
+func messagesRequest(text, tool, description string) string {
+	return fmt.Sprintf(`{"model":"claude","max_tokens":1024,"messages":[{"role":"user","content":[{"type":"text","text":%q}]}],"tools":[{"name":%q,"description":%q,"input_schema":{"type":"object"}}]}`,
+		text, tool, description)
+}
+
+// postMessages sends a request body to the messages endpoint through
+// transport and returns the response body
+func postMessages(transport http.RoundTripper, url string, header http.Header, body string) (string, error) {
+	request, err := http.NewRequest(http.MethodPost, url+"/v1/messages", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header = header
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	return string(data), err
+}
+
+func TestRecorderScrubsSecrets(t *testing.T) {
+	const envKey, headerKey = "sk-ant-env-0123456789", "sk-ant-header-0123456789"
+	t.Setenv("ANTHROPIC_API_KEY", envKey)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"type":"message","content":[{"type":"text","text":"You sent %s"}]}`, r.Header.Get("X-Api-Key"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	header := http.Header{
+		"Content-Type":  {"application/json"},
+		"X-Api-Key":     {headerKey},
+		"Authorization": {"Bearer " + envKey},
+	}
+	body := messagesRequest("My key is "+envKey, "read_file", "Read a file")
+	if _, err := postMessages(NewRecorder(path, nil), server.URL, header, body); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{envKey, headerKey} {
+		if strings.Contains(string(data), key) {
+			t.Errorf("the cassette contains %q:\n%s", key, data)
+		}
+	}
+	for _, want := range []string{"My key is [REDACTED ANTHROPIC_API_KEY]", "You sent [REDACTED X-Api-Key]"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("the cassette doesn't contain %q:\n%s", want, data)
+		}
+	}
+
+	// The same request, with the secrets scrubbed the same way, replays
+	replayer, err := NewReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := postMessages(replayer, "http://replayed", header, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"message","content":[{"type":"text","text":"You sent [REDACTED X-Api-Key]"}]}`; response != want {
+		t.Errorf("replayed response = %s, want %s", response, want)
+	}
+	if replayer.Remaining() != 0 || len(replayer.Drift()) != 0 {
+		t.Errorf("replay left %d interactions and drift %q", replayer.Remaining(), replayer.Drift())
+	}
+}
+
+func TestReplayReportsMismatchedRequests(t *testing.T) {
+	recorded := messagesRequest("Make the greeting in greeting.txt uppercase", "read_file", "Read a file")
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	cassette := Cassette{Interactions: []Interaction{{
+		Request:  RecordedRequest{Method: http.MethodPost, Path: "/v1/messages", Body: requestBodyJSON(recorded)},
+		Response: RecordedResponse{Status: http.StatusOK, Body: "{}"},
+	}}}
+	if err := cassette.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		mismatch bool
+		want     []string
+	}{
+		{
+			name: "changed tool description drifts",
+			body: messagesRequest("Make the greeting in greeting.txt uppercase", "read_file", "Read a file's contents"),
+			want: []string{`-       "description": "Read a file",`, `+       "description": "Read a file's contents",`},
+		},
+		{
+			name:     "changed message",
+			body:     messagesRequest("Make the greeting in greeting.txt lowercase", "read_file", "Read a file"),
+			mismatch: true,
+			want: []string{
+				"doesn't match the cassette",
+				`-           "text": "Make the greeting in greeting.txt uppercase",`,
+				`+           "text": "Make the greeting in greeting.txt lowercase",`,
+			},
+		},
+		{
+			name:     "renamed tool",
+			body:     messagesRequest("Make the greeting in greeting.txt uppercase", "view_file", "Read a file"),
+			mismatch: true,
+			want:     []string{"doesn't match the cassette", `-     "read_file"`, `+     "view_file"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replayer, err := NewReplayer(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = postMessages(replayer, "http://replayed", http.Header{}, test.body)
+			report := strings.Join(replayer.Drift(), "\n")
+			var mismatch *CassetteMismatchError
+			switch {
+			case test.mismatch && !errors.As(err, &mismatch):
+				t.Fatalf("expected a mismatch error, got %v", err)
+			case test.mismatch:
+				report = mismatch.Error()
+			case err != nil:
+				t.Fatalf("drift failed the request: %v", err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(report, want) {
+					t.Errorf("report doesn't contain %q:\n%s", want, report)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory of the project's command templates, relative to the working
+// directory. User commands live in the same place under the user config dir.
+const projectCommandDir = ".agent/commands"
+
+// errQuit is returned by /quit to end the interactive loop
+var errQuit = errors.New("quit")
+
+// commandName matches the first word of a line that is a command. Paths like
+// /usr/bin/env contain a second slash and are sent to the model as usual.
+var commandName = regexp.MustCompile(`^/([A-Za-z0-9_-]+)(?:\s|$)`)
+
+// Command is a slash command typed at the prompt
+type Command struct {
+	Name        string
+	Description string
+	// Usage describes the arguments, e.g. "[model]"
+	Usage string
+	// Source is the template file of a user command, empty for built-ins
+	Source string
+	// Run handles the command. A non-empty prompt is sent to the model as if
+	// the user had typed it.
+	Run func(ctx context.Context, a *Agent, args string) (prompt string, err error)
+}
+
+// builtinCommands returns the commands that control the agent itself
+func builtinCommands() []Command {
+	return []Command{
+		{Name: "help", Description: "List the available commands", Run: runHelp},
+		{Name: "clear", Description: "Start a new conversation", Run: runClear},
+		{Name: "compact", Description: "Summarize the conversation so far to free up context", Run: runCompact},
+		{Name: "cost", Description: "Show the token usage and cost of the session", Run: runCost},
+		{Name: "tools", Description: "List the tools available to the model", Run: runTools},
+		{Name: "model", Usage: "[model]", Description: "Show or switch the model", Run: runModel},
+		{Name: "plan", Usage: "[on|off]", Description: "Toggle plan mode: read-only tools until a plan is approved", Run: runPlan},
+		{Name: "think", Usage: "[on|off|budget]", Description: "Toggle extended thinking or set its token budget", Run: runThink},
+		{Name: "save", Usage: "[path]", Description: "Save a transcript of the conversation as markdown", Run: runSave},
+		{Name: "quit", Description: "Exit the agent", Run: runQuit},
+	}
+}
+
+// AddCommands registers more commands. Commands can't replace ones that are
+// already registered, so built-ins always win over user commands.
+func (a *Agent) AddCommands(commands []Command) {
+	for _, command := range commands {
+		if _, exists := a.findCommand(command.Name); exists {
+			fmt.Fprintf(a.out, "Warning: Ignoring command /%s from %s: the name is already taken\n", command.Name, command.Source)
+			continue
+		}
+		a.commands = append(a.commands, command)
+	}
+}
+
+// findCommand looks up a command by name
+func (a *Agent) findCommand(name string) (Command, bool) {
+	for _, command := range a.commands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return Command{}, false
+}
+
+// handleCommand runs the command on the input line, if it is one. It reports
+// whether the line was a command and returns the prompt to send to the
+// model, if the command produced one.
+func (a *Agent) handleCommand(ctx context.Context, input string) (string, bool, error) {
+	match := commandName.FindStringSubmatch(strings.TrimSpace(input))
+	if match == nil {
+		return "", false, nil
+	}
+	name := match[1]
+	args := strings.TrimSpace(strings.TrimSpace(input)[len(match[1])+1:])
+
+	command, ok := a.findCommand(name)
+	if !ok {
+		message := fmt.Sprintf("Unknown command /%s.", name)
+		if suggestions := a.suggestCommands(name); len(suggestions) > 0 {
+			message += " Did you mean " + strings.Join(suggestions, ", ") + "?"
+		}
+		fmt.Fprintf(a.out, "\u001b[96mcommand\u001b[0m: %s Type /help to list the commands.\n", message)
+		return "", true, nil
+	}
+
+	prompt, err := command.Run(ctx, a, args)
+	return prompt, true, err
+}
+
+// suggestCommands returns the commands whose name is close to name
+func (a *Agent) suggestCommands(name string) []string {
+	suggestions := []string{}
+	for _, command := range a.commands {
+		if strings.HasPrefix(command.Name, name) || strings.HasPrefix(name, command.Name) || editDistance(name, command.Name) <= 2 {
+			suggestions = append(suggestions, "/"+command.Name)
+		}
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func runHelp(ctx context.Context, a *Agent, args string) (string, error) {
+	fmt.Fprintln(a.out, "Commands:")
+	for _, command := range a.commands {
+		usage := "/" + command.Name
+		if command.Usage != "" {
+			usage += " " + command.Usage
+		}
+		fmt.Fprintf(a.out, "  %-24s %s\n", usage, command.Description)
+	}
+	return "", nil
+}
+
+func runClear(ctx context.Context, a *Agent, args string) (string, error) {
+	a.setConversation(nil)
+	a.clearPlan()
+	fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Conversation cleared")
+	return "", nil
+}
+
+func runCompact(ctx context.Context, a *Agent, args string) (string, error) {
+	// Everything but the last turn is summarized
+	if compactionSplit(a.conversation, 1) == 0 {
+		fmt.Fprintln(a.out, "\u001b[96mcompact\u001b[0m: Nothing to compact")
+		return "", nil
+	}
+	if err := a.compact(ctx, 1); err != nil {
+		fmt.Fprintf(a.out, "\u001b[96mcompact\u001b[0m: %s\n", err.Error())
+	} else {
+		fmt.Fprintln(a.out, "\u001b[96mcompact\u001b[0m: Conversation compacted")
+	}
+	return "", nil
+}
+
+func runCost(ctx context.Context, a *Agent, args string) (string, error) {
+	fmt.Fprintln(a.out, a.usage.Report(a.config.Model))
+	return "", nil
+}
+
+func runTools(ctx context.Context, a *Agent, args string) (string, error) {
+	fmt.Fprintln(a.out, "Tools:")
+	for _, tool := range a.activeTools() {
+		description, _, _ := strings.Cut(strings.TrimSpace(tool.Description), "\n")
+		fmt.Fprintf(a.out, "  %-16s %s\n", tool.Name, description)
+	}
+	return "", nil
+}
+
+func runModel(ctx context.Context, a *Agent, args string) (string, error) {
+	if args != "" {
+		a.config.Model = args
+	}
+	fmt.Fprintf(a.out, "\u001b[96minfo\u001b[0m: Using model %s\n", a.config.Model)
+	return "", nil
+}
+
+func runThink(ctx context.Context, a *Agent, args string) (string, error) {
+	config := a.config
+	enabled := !config.thinkingEnabled()
+	switch args {
+	case "":
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		budget, err := strconv.ParseInt(args, 10, 64)
+		if err != nil {
+			fmt.Fprintln(a.out, "\u001b[96mcommand\u001b[0m: Usage: /think [on|off|budget]")
+			return "", nil
+		}
+		config.ThinkingBudget = budget
+		enabled = true
+	}
+	config.Thinking = &enabled
+
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(a.out, "\u001b[91merror\u001b[0m: %s\n", err.Error())
+		return "", nil
+	}
+	a.config = config
+	if enabled {
+		fmt.Fprintf(a.out, "\u001b[96minfo\u001b[0m: Thinking enabled with a budget of %d tokens\n", config.ThinkingBudget)
+	} else {
+		fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Thinking disabled")
+	}
+	return "", nil
+}
+
+func runPlan(ctx context.Context, a *Agent, args string) (string, error) {
+	enabled := !a.inPlanMode()
+	switch args {
+	case "":
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		fmt.Fprintln(a.out, "\u001b[96mcommand\u001b[0m: Usage: /plan [on|off]")
+		return "", nil
+	}
+	a.SetPlanMode(enabled)
+	if enabled {
+		fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Plan mode on: Claude can only use read-only tools until you approve a plan")
+	} else {
+		fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Plan mode off: all tools are available")
+	}
+	return "", nil
+}
+
+func runSave(ctx context.Context, a *Agent, args string) (string, error) {
+	path := args
+	if path == "" {
+		path = fmt.Sprintf("transcript-%s.md", time.Now().Format("20060102-150405"))
+	}
+	if err := os.WriteFile(path, []byte(renderTranscript(a.conversation, 0)), 0644); err != nil {
+		fmt.Fprintf(a.out, "\u001b[91merror\u001b[0m: Failed to save transcript: %s\n", err.Error())
+		return "", nil
+	}
+	fmt.Fprintf(a.out, "\u001b[96minfo\u001b[0m: Saved transcript to %s\n", path)
+	return "", nil
+}
+
+func runQuit(ctx context.Context, a *Agent, args string) (string, error) {
+	return "", errQuit
+}
+
+// LoadUserCommands reads the markdown command templates from the user config
+// directory and the project's .agent/commands directory. The file name
+// without its extension is the command name; project commands take
+// precedence over user commands of the same name.
+func LoadUserCommands(out io.Writer, workingDir string) []Command {
+	dirs := []string{}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(configDir, "agent", "commands"))
+	}
+	dirs = append(dirs, filepath.Join(workingDir, projectCommandDir))
+
+	byName := map[string]Command{}
+	for _, dir := range dirs {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.md"))
+		for _, path := range paths {
+			command, err := loadCommandTemplate(path)
+			if err != nil {
+				fmt.Fprintf(out, "Warning: Skipping command %s: %v\n", path, err)
+				continue
+			}
+			byName[command.Name] = command
+		}
+	}
+
+	commands := make([]Command, 0, len(byName))
+	for _, name := range sortedKeys(byName) {
+		commands = append(commands, byName[name])
+	}
+	return commands
+}
+
+// loadCommandTemplate reads a command template. An optional front matter
+// block at the top may set the description and argument usage:
+//
+//	---
+//	description: Review the staged changes
+//	usage: [focus]
+//	---
+func loadCommandTemplate(path string) (Command, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if !commandName.MatchString("/" + name) {
+		return Command{}, fmt.Errorf("invalid command name %q", name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Command{}, err
+	}
+
+	command := Command{Name: name, Source: path}
+	body := string(data)
+	if rest, ok := strings.CutPrefix(body, "---\n"); ok {
+		frontMatter, afterFrontMatter, found := strings.Cut(rest, "\n---\n")
+		if !found {
+			return Command{}, fmt.Errorf("unterminated front matter")
+		}
+		for _, line := range strings.Split(frontMatter, "\n") {
+			key, value, _ := strings.Cut(line, ":")
+			switch strings.TrimSpace(key) {
+			case "description":
+				command.Description = strings.TrimSpace(value)
+			case "usage":
+				command.Usage = strings.TrimSpace(value)
+			}
+		}
+		body = afterFrontMatter
+	}
+	if command.Description == "" {
+		command.Description = "User command from " + path
+	}
+
+	template := strings.TrimSpace(body)
+	command.Run = func(ctx context.Context, a *Agent, args string) (string, error) {
+		return expandCommandTemplate(template, args), nil
+	}
+	return command, nil
+}
+
+// templateArgument matches $ARGUMENTS and the positional $1 to $9
+var templateArgument = regexp.MustCompile(`\$(ARGUMENTS|[1-9])`)
+
+// expandCommandTemplate substitutes the arguments into a template:
+// $ARGUMENTS is everything after the command name and $1, $2, ... are the
+// whitespace separated words. Missing positional arguments become empty.
+func expandCommandTemplate(template, args string) string {
+	fields := strings.Fields(args)
+	return templateArgument.ReplaceAllStringFunc(template, func(match string) string {
+		if match == "$ARGUMENTS" {
+			return args
+		}
+		index, _ := strconv.Atoi(match[1:])
+		if index > len(fields) {
+			return ""
+		}
+		return fields[index-1]
+	})
+}
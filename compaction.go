@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// Default estimated token count at which the conversation is compacted.
+	// Leaves plenty of headroom below the model's 200k context window.
+	defaultCompactThreshold = 150000
+	// Default number of recent user turns that are always kept verbatim
+	defaultCompactKeepTurns = 4
+	// Longest tool result excerpt included in the transcript sent for summarizing
+	maxSummaryToolResultChars = 2000
+)
+
+const compactionPrompt = `Summarize the following conversation between a user and an AI coding agent so the agent can continue the work without the original messages.
+
+Keep:
+- the user's goals and any instructions or preferences they gave
+- files that were read, created or edited, and what changed in them
+- important findings from tool output (errors, test results, key code locations)
+- decisions made and work that is still outstanding
+
+Be concise and factual. Reply with the summary only.`
+
+// CompactionConfig controls when the conversation is automatically compacted
+type CompactionConfig struct {
+	// Threshold is the estimated token count above which compaction kicks in.
+	// Zero or less disables automatic compaction.
+	Threshold int
+	// KeepTurns is the number of most recent user turns kept verbatim. The
+	// last one is kept even if it is zero.
+	KeepTurns int
+}
+
+// NewCompactionConfigFromEnv reads COMPACT_THRESHOLD and COMPACT_KEEP_TURNS,
+// falling back to the defaults when they are unset or invalid.
+func NewCompactionConfigFromEnv() CompactionConfig {
+	config := CompactionConfig{
+		Threshold: defaultCompactThreshold,
+		KeepTurns: defaultCompactKeepTurns,
+	}
+	if value, err := strconv.Atoi(os.Getenv("COMPACT_THRESHOLD")); err == nil {
+		config.Threshold = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("COMPACT_KEEP_TURNS")); err == nil && value >= 0 {
+		config.KeepTurns = value
+	}
+	return config
+}
+
+// estimateTokens gives a rough token count for a message using the common
+// approximation of four bytes of JSON per token. Images are billed by size
+// rather than by their base64 data, so they are counted separately.
+func estimateTokens(message anthropic.MessageParam) int {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return 0
+	}
+	size := len(data)
+	tokens := 1
+	countImage := func(image *anthropic.ImageBlockParam) {
+		if image != nil && image.Source.OfBase64ImageSource != nil {
+			size -= len(image.Source.OfBase64ImageSource.Data)
+			tokens += imageTokenEstimate
+		}
+	}
+	for _, block := range message.Content {
+		countImage(block.OfRequestImageBlock)
+		if block.OfRequestToolResultBlock != nil {
+			for _, content := range block.OfRequestToolResultBlock.Content {
+				countImage(content.OfRequestImageBlock)
+			}
+		}
+	}
+	return tokens + size/4
+}
+
+// estimateConversationTokens returns the estimated token count of each message
+// along with the total for the whole conversation.
+func estimateConversationTokens(conversation []anthropic.MessageParam) ([]int, int) {
+	perMessage := make([]int, len(conversation))
+	total := 0
+	for i, message := range conversation {
+		perMessage[i] = estimateTokens(message)
+		total += perMessage[i]
+	}
+	return perMessage, total
+}
+
+// isTurnStart reports whether a message starts a new user turn, i.e. it is a
+// user message that isn't just carrying tool results back to the model.
+func isTurnStart(message anthropic.MessageParam) bool {
+	if message.Role != anthropic.MessageParamRoleUser {
+		return false
+	}
+	for _, block := range message.Content {
+		if block.OfRequestToolResultBlock != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// compactionSplit returns the index of the first message that should be kept
+// verbatim when the last keepTurns user turns are preserved. At least the
+// last turn start is always kept, so the message waiting for a reply is
+// never summarized. Splitting at the start of a turn guarantees every
+// tool_use stays with its tool_result. If there aren't enough turns, e.g.
+// during one long agentic turn, the split falls between tool exchanges of
+// the current turn instead. A result of zero means there is nothing old
+// enough to compact.
+func compactionSplit(conversation []anthropic.MessageParam, keepTurns int) int {
+	keepTurns = max(keepTurns, 1)
+	turns, lastTurnStart := 0, 0
+	for i := len(conversation) - 1; i >= 0; i-- {
+		if !isTurnStart(conversation[i]) {
+			continue
+		}
+		turns++
+		if turns == 1 {
+			lastTurnStart = i
+		}
+		if turns == keepTurns && i > 0 {
+			return i
+		}
+	}
+	return toolExchangeSplit(conversation, lastTurnStart, keepTurns)
+}
+
+// toolExchangeSplit splits the turn starting at turnStart before one of its
+// assistant messages that follows tool results, keeping the last keep tool
+// exchanges or as many as there are after the first. Everything from the
+// split on still pairs every tool_use with its tool_result.
+func toolExchangeSplit(conversation []anthropic.MessageParam, turnStart, keep int) int {
+	boundaries := []int{}
+	for i := turnStart + 1; i < len(conversation); i++ {
+		if conversation[i].Role == anthropic.MessageParamRoleAssistant && carriesToolResults(conversation[i-1]) {
+			boundaries = append(boundaries, i)
+		}
+	}
+	if len(boundaries) == 0 {
+		return 0
+	}
+	return boundaries[max(len(boundaries)-keep, 0)]
+}
+
+// carriesToolResults reports whether a message returns tool results
+func carriesToolResults(message anthropic.MessageParam) bool {
+	for _, block := range message.Content {
+		if block.OfRequestToolResultBlock != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// renderTranscript flattens messages into plain text for the summarizer and
+// /save, so that tool blocks don't need to be valid on their own. Tool
+// results longer than maxToolResultChars are cut short; zero keeps them whole.
+func renderTranscript(messages []anthropic.MessageParam, maxToolResultChars int) string {
+	var transcript strings.Builder
+	for _, message := range messages {
+		for _, block := range message.Content {
+			switch {
+			case block.OfRequestTextBlock != nil:
+				fmt.Fprintf(&transcript, "%s: %s\n\n", message.Role, block.OfRequestTextBlock.Text)
+			case block.OfRequestImageBlock != nil:
+				fmt.Fprintf(&transcript, "%s: [image]\n\n", message.Role)
+			case block.OfRequestToolUseBlock != nil:
+				input, _ := json.Marshal(block.OfRequestToolUseBlock.Input)
+				fmt.Fprintf(&transcript, "%s called tool %s(%s)\n\n", message.Role, block.OfRequestToolUseBlock.Name, input)
+			case block.OfRequestToolResultBlock != nil:
+				var result strings.Builder
+				for _, content := range block.OfRequestToolResultBlock.Content {
+					if content.OfRequestTextBlock != nil {
+						result.WriteString(content.OfRequestTextBlock.Text)
+					}
+					if content.OfRequestImageBlock != nil {
+						result.WriteString("\n[image]")
+					}
+				}
+				text := result.String()
+				if maxToolResultChars > 0 && len(text) > maxToolResultChars {
+					text = text[:maxToolResultChars] + "\n[... truncated ...]"
+				}
+				fmt.Fprintf(&transcript, "tool result:\n%s\n\n", text)
+			}
+		}
+	}
+	return transcript.String()
+}
+
+// compact summarizes everything before the last keepTurns user turns, or the
+// older tool exchanges of the current turn, into a synthetic summary. The
+// conversation is left unchanged when there is nothing old enough to
+// summarize.
+func (a *Agent) compact(ctx context.Context, keepTurns int) error {
+	conversation := a.conversation
+	split := compactionSplit(conversation, keepTurns)
+	if split == 0 {
+		return nil
+	}
+
+	request := anthropic.NewUserMessage(anthropic.NewTextBlock(
+		compactionPrompt + "\n\n<conversation>\n" + renderTranscript(conversation[:split], maxSummaryToolResultChars) + "</conversation>",
+	))
+	message, err := withRetry(ctx, a.out, a.config.maxRetries(), func() (*anthropic.Message, error) {
+		stream := a.provider.Stream(ctx, InferenceRequest{
+			Model:     a.config.Model,
+			MaxTokens: a.config.MaxTokens,
+			Messages:  []anthropic.MessageParam{request},
+		})
+		return accumulateStream(stream, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to summarize conversation: %w", err)
+	}
+	a.usage.RecordInference(a.config.Model, "compaction", message.Usage)
+
+	var summary strings.Builder
+	for _, content := range message.Content {
+		if content.Type == "text" {
+			summary.WriteString(content.Text)
+		}
+	}
+
+	// Unless the kept messages start in the middle of a turn, with the
+	// assistant's next tool call, the summary is followed by an
+	// acknowledgement so that user and assistant turns keep alternating
+	compacted := []anthropic.MessageParam{
+		anthropic.NewUserMessage(anthropic.NewTextBlock("[Summary of the earlier conversation]\n\n" + summary.String())),
+	}
+	if conversation[split].Role != anthropic.MessageParamRoleAssistant {
+		compacted = append(compacted, anthropic.NewAssistantMessage(anthropic.NewTextBlock("Understood. I'll continue from this summary.")))
+	}
+	a.setConversation(append(compacted, conversation[split:]...))
+	return nil
+}
+
+// maybeCompact compacts the conversation once its estimated size crosses the
+// configured threshold.
+func (a *Agent) maybeCompact(ctx context.Context) error {
+	if a.compaction.Threshold <= 0 {
+		return nil
+	}
+	perMessage, total := estimateConversationTokens(a.conversation)
+	if a.debugMode && len(perMessage) > 0 {
+		fmt.Fprintf(a.out, "\u001b[96mdebug\u001b[0m: Conversation is ~%d tokens (last message ~%d)\n", total, perMessage[len(perMessage)-1])
+	}
+	if total < a.compaction.Threshold || compactionSplit(a.conversation, a.compaction.KeepTurns) == 0 {
+		return nil
+	}
+
+	if err := a.compact(ctx, a.compaction.KeepTurns); err != nil {
+		return err
+	}
+	_, after := estimateConversationTokens(a.conversation)
+	fmt.Fprintf(a.out, "\u001b[96mcompact\u001b[0m: Compacted conversation from ~%d to ~%d tokens\n", total, after)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func userText(text string) anthropic.MessageParam {
+	return anthropic.NewUserMessage(anthropic.NewTextBlock(text))
+}
+
+func assistantText(text string) anthropic.MessageParam {
+	return anthropic.NewAssistantMessage(anthropic.NewTextBlock(text))
+}
+
+func toolUse(id string) anthropic.MessageParam {
+	return anthropic.NewAssistantMessage(anthropic.ContentBlockParamUnion{OfRequestToolUseBlock: &anthropic.ToolUseBlockParam{
+		ID: id, Name: "read_file", Input: map[string]any{},
+	}})
+}
+
+func toolResult(id string) anthropic.MessageParam {
+	return anthropic.NewUserMessage(anthropic.NewToolResultBlock(id, "content", false))
+}
+
+func TestCompactionSplit(t *testing.T) {
+	twoTurns := []anthropic.MessageParam{
+		userText("first"), assistantText("one"),
+		userText("second"), toolUse("a"), toolResult("a"), assistantText("two"),
+	}
+	// A single turn that has gone on for several tool calls, waiting for
+	// the model's reply to the last result
+	longTurn := []anthropic.MessageParam{
+		userText("task"),
+		toolUse("a"), toolResult("a"),
+		toolUse("b"), toolResult("b"),
+		toolUse("c"), toolResult("c"),
+	}
+
+	tests := []struct {
+		name         string
+		conversation []anthropic.MessageParam
+		keepTurns    int
+		want         int
+	}{
+		{"keeps the last turns", twoTurns, 1, 2},
+		{"keeps the last turn when asked for none", twoTurns, 0, 2},
+		{"too few turns splits inside the last one", twoTurns, 2, 5},
+		{"splits between tool exchanges of one turn", longTurn, 1, 5},
+		{"keeps as many exchanges as turns", longTurn, 2, 3},
+		{"keeps all but the first exchange", longTurn, 4, 3},
+		{"waiting for the first reply", []anthropic.MessageParam{userText("task")}, 0, 0},
+		{"no tool exchanges to split at", []anthropic.MessageParam{userText("task"), toolUse("a"), toolResult("a")}, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := compactionSplit(test.conversation, test.keepTurns); got != test.want {
+				t.Errorf("compactionSplit = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompactionInsideLongTurn(t *testing.T) {
+	useWorkspace(t, map[string]string{"notes.txt": "remember the milk\n"})
+
+	read := Call{"read_file", map[string]any{"path": "notes.txt"}}
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{read}},
+		Turn{Calls: []Call{read}},
+		// Compaction is due before every request once there is an earlier
+		// tool exchange to summarize
+		Turn{Text: "The agent read notes.txt once."},
+		Turn{Calls: []Call{read}},
+		Turn{Text: "The agent read notes.txt twice."},
+		Turn{Expect: []Result{{Contains: "remember the milk"}}, Text: "Done."},
+	)
+	agent := newScriptedAgent(provider, builtinTools, "Read my notes")
+	agent.compaction = CompactionConfig{Threshold: 1, KeepTurns: 1}
+	runAgent(t, agent)
+
+	// The summary replaces the prompt and is followed by the latest tool
+	// exchange, without an acknowledgement in between
+	last := provider.requests[len(provider.requests)-1].Messages
+	if len(last) != 3 || last[1].Role != anthropic.MessageParamRoleAssistant || last[2].Content[0].OfRequestToolResultBlock == nil {
+		t.Fatalf("compacted conversation has %d messages: %+v", len(last), last)
+	}
+	if text := last[0].Content[0].OfRequestTextBlock; text == nil || text.Text != "[Summary of the earlier conversation]\n\nThe agent read notes.txt twice." {
+		t.Errorf("first message = %+v, want the summary", last[0].Content[0])
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Default location of the project config file
+const defaultConfigPath = ".agent/config.json"
+
+// The API's lower limit for the thinking budget
+const minThinkingBudget = 1024
+
+// Config holds the model settings used for inference. Values are layered:
+// built-in defaults, then the config file, then environment variables, and
+// finally command line flags.
+type Config struct {
+	// Provider is the model API: "anthropic" (the default) or "openai" for
+	// OpenAI-compatible servers
+	Provider string `json:"provider,omitempty"`
+	// BaseURL overrides the API endpoint of the provider
+	BaseURL       string   `json:"base_url,omitempty"`
+	Model         string   `json:"model,omitempty"`
+	MaxTokens     int64    `json:"max_tokens,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	// MaxRetries is how many times a request that failed with a transient
+	// error is retried
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// MaxParallelTools limits how many tool calls from one response run at
+	// the same time. 1 runs them one after another.
+	MaxParallelTools int `json:"max_parallel_tools,omitempty"`
+	// Pricing adds to or overrides the built-in model prices
+	Pricing map[string]ModelPricing `json:"pricing,omitempty"`
+	// BudgetUSD is the session spend after which the user is asked before
+	// continuing. Zero means no budget.
+	BudgetUSD float64 `json:"budget_usd,omitempty"`
+	// Thinking enables extended thinking, letting the model spend up to
+	// ThinkingBudget tokens of each response reasoning before it answers
+	Thinking       *bool `json:"thinking,omitempty"`
+	ThinkingBudget int64 `json:"thinking_budget,omitempty"`
+	// TaskMaxTurns and TaskMaxTokens limit the model responses and the total
+	// tokens a sub-agent started by the task tool may use
+	TaskMaxTurns  int   `json:"task_max_turns,omitempty"`
+	TaskMaxTokens int64 `json:"task_max_tokens,omitempty"`
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	maxRetries := 5
+	return Config{
+		Model:            string(anthropic.ModelClaude3_7SonnetLatest),
+		MaxTokens:        8192,
+		MaxRetries:       &maxRetries,
+		MaxParallelTools: 4,
+		ThinkingBudget:   4096,
+		TaskMaxTurns:     20,
+		TaskMaxTokens:    500000,
+	}
+}
+
+// LoadConfig builds a Config from the defaults, the config file at path (if
+// it exists) and the AGENT_* environment variables.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return config, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err == nil {
+		var fileConfig Config
+		if err := json.Unmarshal(data, &fileConfig); err != nil {
+			return config, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		config.merge(fileConfig)
+	}
+
+	envConfig, err := configFromEnv()
+	if err != nil {
+		return config, err
+	}
+	config.merge(envConfig)
+
+	return config, config.Validate()
+}
+
+// configFromEnv reads AGENT_PROVIDER, AGENT_BASE_URL, AGENT_MODEL,
+// AGENT_MAX_TOKENS, AGENT_TEMPERATURE,
+// AGENT_STOP_SEQUENCES (comma separated), AGENT_MAX_RETRIES,
+// AGENT_MAX_PARALLEL_TOOLS, AGENT_BUDGET_USD, AGENT_THINKING,
+// AGENT_THINKING_BUDGET, AGENT_TASK_MAX_TURNS and AGENT_TASK_MAX_TOKENS.
+func configFromEnv() (Config, error) {
+	config := Config{
+		Provider: os.Getenv("AGENT_PROVIDER"),
+		BaseURL:  os.Getenv("AGENT_BASE_URL"),
+		Model:    os.Getenv("AGENT_MODEL"),
+	}
+
+	if value := os.Getenv("AGENT_MAX_TOKENS"); value != "" {
+		maxTokens, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_MAX_TOKENS: %w", err)
+		}
+		config.MaxTokens = maxTokens
+	}
+	if value := os.Getenv("AGENT_TEMPERATURE"); value != "" {
+		temperature, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_TEMPERATURE: %w", err)
+		}
+		config.Temperature = &temperature
+	}
+	if value := os.Getenv("AGENT_STOP_SEQUENCES"); value != "" {
+		config.StopSequences = splitList(value)
+	}
+	if value := os.Getenv("AGENT_MAX_RETRIES"); value != "" {
+		maxRetries, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_MAX_RETRIES: %w", err)
+		}
+		config.MaxRetries = &maxRetries
+	}
+	if value := os.Getenv("AGENT_MAX_PARALLEL_TOOLS"); value != "" {
+		maxParallelTools, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_MAX_PARALLEL_TOOLS: %w", err)
+		}
+		config.MaxParallelTools = maxParallelTools
+	}
+	if value := os.Getenv("AGENT_BUDGET_USD"); value != "" {
+		budget, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_BUDGET_USD: %w", err)
+		}
+		config.BudgetUSD = budget
+	}
+	if value := os.Getenv("AGENT_THINKING"); value != "" {
+		thinking, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_THINKING: %w", err)
+		}
+		config.Thinking = &thinking
+	}
+	if value := os.Getenv("AGENT_THINKING_BUDGET"); value != "" {
+		thinkingBudget, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_THINKING_BUDGET: %w", err)
+		}
+		config.ThinkingBudget = thinkingBudget
+	}
+	if value := os.Getenv("AGENT_TASK_MAX_TURNS"); value != "" {
+		taskMaxTurns, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_TASK_MAX_TURNS: %w", err)
+		}
+		config.TaskMaxTurns = taskMaxTurns
+	}
+	if value := os.Getenv("AGENT_TASK_MAX_TOKENS"); value != "" {
+		taskMaxTokens, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid AGENT_TASK_MAX_TOKENS: %w", err)
+		}
+		config.TaskMaxTokens = taskMaxTokens
+	}
+
+	return config, nil
+}
+
+// merge overrides c with every field that is set in other
+func (c *Config) merge(other Config) {
+	if other.Provider != "" {
+		c.Provider = other.Provider
+	}
+	if other.BaseURL != "" {
+		c.BaseURL = other.BaseURL
+	}
+	if other.Model != "" {
+		c.Model = other.Model
+	}
+	if other.MaxTokens != 0 {
+		c.MaxTokens = other.MaxTokens
+	}
+	if other.Temperature != nil {
+		c.Temperature = other.Temperature
+	}
+	if len(other.StopSequences) > 0 {
+		c.StopSequences = other.StopSequences
+	}
+	if other.MaxRetries != nil {
+		c.MaxRetries = other.MaxRetries
+	}
+	if other.MaxParallelTools != 0 {
+		c.MaxParallelTools = other.MaxParallelTools
+	}
+	for model, price := range other.Pricing {
+		if c.Pricing == nil {
+			c.Pricing = map[string]ModelPricing{}
+		}
+		c.Pricing[model] = price
+	}
+	if other.BudgetUSD != 0 {
+		c.BudgetUSD = other.BudgetUSD
+	}
+	if other.Thinking != nil {
+		c.Thinking = other.Thinking
+	}
+	if other.ThinkingBudget != 0 {
+		c.ThinkingBudget = other.ThinkingBudget
+	}
+	if other.TaskMaxTurns != 0 {
+		c.TaskMaxTurns = other.TaskMaxTurns
+	}
+	if other.TaskMaxTokens != 0 {
+		c.TaskMaxTokens = other.TaskMaxTokens
+	}
+}
+
+// Validate checks that the settings will be accepted by the API
+func (c Config) Validate() error {
+	if c.Provider != "" && c.Provider != providerAnthropic && c.Provider != providerOpenAI {
+		return fmt.Errorf("provider must be %q or %q, got %q", providerAnthropic, providerOpenAI, c.Provider)
+	}
+	if c.Model == "" {
+		return fmt.Errorf("model cannot be empty")
+	}
+	if c.MaxTokens <= 0 {
+		return fmt.Errorf("max tokens must be positive, got %d", c.MaxTokens)
+	}
+	if c.Temperature != nil && (*c.Temperature < 0 || *c.Temperature > 1) {
+		return fmt.Errorf("temperature must be between 0 and 1, got %g", *c.Temperature)
+	}
+	if c.MaxRetries != nil && *c.MaxRetries < 0 {
+		return fmt.Errorf("max retries cannot be negative, got %d", *c.MaxRetries)
+	}
+	if c.MaxParallelTools < 0 {
+		return fmt.Errorf("max parallel tools cannot be negative, got %d", c.MaxParallelTools)
+	}
+	if c.BudgetUSD < 0 {
+		return fmt.Errorf("budget cannot be negative, got %g", c.BudgetUSD)
+	}
+	if c.TaskMaxTurns <= 0 {
+		return fmt.Errorf("task max turns must be positive, got %d", c.TaskMaxTurns)
+	}
+	if c.TaskMaxTokens <= 0 {
+		return fmt.Errorf("task max tokens must be positive, got %d", c.TaskMaxTokens)
+	}
+	if c.thinkingEnabled() {
+		if c.ThinkingBudget < minThinkingBudget {
+			return fmt.Errorf("thinking budget must be at least %d tokens, got %d", minThinkingBudget, c.ThinkingBudget)
+		}
+		if c.ThinkingBudget >= c.MaxTokens {
+			return fmt.Errorf("thinking budget must be less than max tokens (%d), got %d", c.MaxTokens, c.ThinkingBudget)
+		}
+		if c.Temperature != nil && *c.Temperature != 1 {
+			return fmt.Errorf("temperature cannot be set when thinking is enabled")
+		}
+		if c.Provider == providerOpenAI {
+			return fmt.Errorf("thinking is only supported by the %s provider", providerAnthropic)
+		}
+	}
+	return nil
+}
+
+// thinkingEnabled reports whether extended thinking is switched on
+func (c Config) thinkingEnabled() bool {
+	return c.Thinking != nil && *c.Thinking
+}
+
+// maxRetries returns the configured retry count, defaulting to none
+func (c Config) maxRetries() int {
+	if c.MaxRetries == nil {
+		return 0
+	}
+	return *c.MaxRetries
+}
+
+// maxParallelTools returns the tool worker limit, which is at least one
+func (c Config) maxParallelTools() int {
+	if c.MaxParallelTools < 1 {
+		return 1
+	}
+	return c.MaxParallelTools
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// ModelPricing is the price of a model in USD per million tokens
+type ModelPricing struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheWrite float64 `json:"cache_write"`
+	CacheRead  float64 `json:"cache_read"`
+}
+
+// Prices of the Claude models, keyed by model name prefix so that dated and
+// "-latest" aliases share an entry. Overridable through the config file.
+var defaultPricing = map[string]ModelPricing{
+	"claude-opus-4":     {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.5},
+	"claude-sonnet-4":   {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-7-sonnet": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-5-sonnet": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-5-haiku":  {Input: 0.8, Output: 4, CacheWrite: 1, CacheRead: 0.08},
+	"claude-3-opus":     {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.5},
+	"claude-3-haiku":    {Input: 0.25, Output: 1.25, CacheWrite: 0.3, CacheRead: 0.03},
+}
+
+// lookupPricing finds the price of a model by exact name, falling back to the
+// longest matching prefix. Unknown models are reported as free.
+func lookupPricing(pricing map[string]ModelPricing, model string) (ModelPricing, bool) {
+	if price, ok := pricing[model]; ok {
+		return price, true
+	}
+	best := ""
+	for prefix := range pricing {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return ModelPricing{}, false
+	}
+	return pricing[best], true
+}
+
+// TokenUsage counts the tokens of one or more requests
+type TokenUsage struct {
+	Input      int64 `json:"input_tokens"`
+	Output     int64 `json:"output_tokens"`
+	CacheWrite int64 `json:"cache_creation_input_tokens"`
+	CacheRead  int64 `json:"cache_read_input_tokens"`
+}
+
+func newTokenUsage(usage anthropic.Usage) TokenUsage {
+	return TokenUsage{
+		Input:      usage.InputTokens,
+		Output:     usage.OutputTokens,
+		CacheWrite: usage.CacheCreationInputTokens,
+		CacheRead:  usage.CacheReadInputTokens,
+	}
+}
+
+// Total is the number of tokens of every kind
+func (u TokenUsage) Total() int64 {
+	return u.Input + u.Output + u.CacheWrite + u.CacheRead
+}
+
+func (u *TokenUsage) add(other TokenUsage) {
+	u.Input += other.Input
+	u.Output += other.Output
+	u.CacheWrite += other.CacheWrite
+	u.CacheRead += other.CacheRead
+}
+
+// Cost prices the usage in USD
+func (u TokenUsage) Cost(price ModelPricing) float64 {
+	return (float64(u.Input)*price.Input +
+		float64(u.Output)*price.Output +
+		float64(u.CacheWrite)*price.CacheWrite +
+		float64(u.CacheRead)*price.CacheRead) / 1e6
+}
+
+// usageTotals aggregates the requests made for one model or purpose
+type usageTotals struct {
+	Requests int
+	Usage    TokenUsage
+	Cost     float64
+}
+
+// toolTotals aggregates the calls of one tool. Tools don't use tokens
+// themselves, but their results are sent back to the model as input.
+type toolTotals struct {
+	Calls        int
+	ResultTokens int
+}
+
+// UsageTracker accounts for the tokens and cost of a session
+type UsageTracker struct {
+	pricing map[string]ModelPricing
+
+	mu        sync.Mutex
+	session   usageTotals
+	turn      usageTotals
+	byModel   map[string]*usageTotals
+	byPurpose map[string]*usageTotals
+	byTool    map[string]*toolTotals
+	// approvedBudget is the spend the user has agreed to so far
+	approvedBudget float64
+
+	// parent also receives everything recorded by a sub-agent's tracker,
+	// under parentPurpose
+	parent        *UsageTracker
+	parentPurpose string
+}
+
+// NewUsageTracker creates a tracker that prices requests with the given
+// table, on top of the built-in prices.
+func NewUsageTracker(pricing map[string]ModelPricing, budget float64) *UsageTracker {
+	merged := map[string]ModelPricing{}
+	for model, price := range defaultPricing {
+		merged[model] = price
+	}
+	for model, price := range pricing {
+		merged[model] = price
+	}
+	return &UsageTracker{
+		pricing:        merged,
+		byModel:        map[string]*usageTotals{},
+		byPurpose:      map[string]*usageTotals{},
+		byTool:         map[string]*toolTotals{},
+		approvedBudget: budget,
+	}
+}
+
+// NewChild creates a tracker for a sub-agent. It counts the sub-agent's usage
+// on its own and adds it to t under the given purpose, and it is held to the
+// budget of the session rather than one of its own.
+func (t *UsageTracker) NewChild(purpose string) *UsageTracker {
+	child := NewUsageTracker(nil, 0)
+	child.pricing = t.pricing
+	child.parent = t
+	child.parentPurpose = purpose
+	return child
+}
+
+// RecordInference adds the usage of one request. The purpose ("chat",
+// "compaction", ...) is only used to break down the totals.
+func (t *UsageTracker) RecordInference(model, purpose string, usage anthropic.Usage) {
+	tokens := newTokenUsage(usage)
+	price, _ := lookupPricing(t.pricing, model)
+	cost := tokens.Cost(price)
+
+	t.mu.Lock()
+	for _, totals := range []*usageTotals{&t.session, &t.turn, t.totalsFor(t.byModel, model), t.totalsFor(t.byPurpose, purpose)} {
+		totals.Requests++
+		totals.Usage.add(tokens)
+		totals.Cost += cost
+	}
+	t.mu.Unlock()
+
+	if t.parent != nil {
+		t.parent.RecordInference(model, t.parentPurpose, usage)
+	}
+}
+
+// RecordToolCall adds a tool call and the estimated size of its result
+func (t *UsageTracker) RecordToolCall(name string, resultTokens int) {
+	t.mu.Lock()
+	totals, ok := t.byTool[name]
+	if !ok {
+		totals = &toolTotals{}
+		t.byTool[name] = totals
+	}
+	totals.Calls++
+	totals.ResultTokens += resultTokens
+	t.mu.Unlock()
+
+	if t.parent != nil {
+		t.parent.RecordToolCall(name, resultTokens)
+	}
+}
+
+func (t *UsageTracker) totalsFor(totals map[string]*usageTotals, key string) *usageTotals {
+	if _, ok := totals[key]; !ok {
+		totals[key] = &usageTotals{}
+	}
+	return totals[key]
+}
+
+// SessionCost returns the total cost of the session so far
+func (t *UsageTracker) SessionCost() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.session.Cost
+}
+
+// SessionUsage returns the total tokens used in the session so far
+func (t *UsageTracker) SessionUsage() TokenUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.session.Usage
+}
+
+// EndTurn returns a one line summary of the turn that just finished and
+// starts counting a new one.
+func (t *UsageTracker) EndTurn() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	turn := t.turn
+	t.turn = usageTotals{}
+	if turn.Requests == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s in · %s out · %s cache read · %s cache write · $%.4f (session $%.4f)",
+		formatTokens(turn.Usage.Input), formatTokens(turn.Usage.Output),
+		formatTokens(turn.Usage.CacheRead), formatTokens(turn.Usage.CacheWrite),
+		turn.Cost, t.session.Cost)
+}
+
+// OverBudget reports whether spending the projected amount on top of what
+// was already spent would exceed the approved budget. A budget of zero
+// means there is no limit. A sub-agent's tracker answers for the session.
+func (t *UsageTracker) OverBudget(projected float64) bool {
+	if t.parent != nil {
+		return t.parent.OverBudget(projected)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.approvedBudget > 0 && t.session.Cost+projected > t.approvedBudget
+}
+
+// ExtendBudget approves spending another amount
+func (t *UsageTracker) ExtendBudget(amount float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.approvedBudget += amount
+}
+
+// InputCost prices a number of input tokens for the given model
+func (t *UsageTracker) InputCost(model string, tokens int) float64 {
+	price, _ := lookupPricing(t.pricing, model)
+	return float64(tokens) * price.Input / 1e6
+}
+
+// Report returns the /cost breakdown of the session
+func (t *UsageTracker) Report(model string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var report strings.Builder
+	fmt.Fprintf(&report, "Session: %d requests, $%.4f\n", t.session.Requests, t.session.Cost)
+	fmt.Fprintf(&report, "  input %s · output %s · cache read %s · cache write %s\n",
+		formatTokens(t.session.Usage.Input), formatTokens(t.session.Usage.Output),
+		formatTokens(t.session.Usage.CacheRead), formatTokens(t.session.Usage.CacheWrite))
+	if t.approvedBudget > 0 {
+		fmt.Fprintf(&report, "  budget $%.2f ($%.4f left)\n", t.approvedBudget, t.approvedBudget-t.session.Cost)
+	}
+
+	writeTotals := func(title string, totals map[string]*usageTotals) {
+		if len(totals) == 0 {
+			return
+		}
+		fmt.Fprintf(&report, "%s:\n", title)
+		for _, key := range sortedKeys(totals) {
+			entry := totals[key]
+			_, known := lookupPricing(t.pricing, key)
+			note := ""
+			if title == "By model" && !known {
+				note = " (no pricing configured)"
+			}
+			fmt.Fprintf(&report, "  %-28s %4d requests  %8s in  %8s out  $%.4f%s\n",
+				key, entry.Requests, formatTokens(entry.Usage.Input), formatTokens(entry.Usage.Output), entry.Cost, note)
+		}
+	}
+	writeTotals("By model", t.byModel)
+	writeTotals("By purpose", t.byPurpose)
+
+	if len(t.byTool) > 0 {
+		report.WriteString("By tool (results sent back as input):\n")
+		for _, name := range sortedKeys(t.byTool) {
+			entry := t.byTool[name]
+			price, _ := lookupPricing(t.pricing, model)
+			fmt.Fprintf(&report, "  %-28s %4d calls  ~%8s tokens  ~$%.4f\n",
+				name, entry.Calls, formatTokens(int64(entry.ResultTokens)), float64(entry.ResultTokens)*price.Input/1e6)
+		}
+	}
+
+	return strings.TrimRight(report.String(), "\n")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatTokens abbreviates large token counts, e.g. 12.3k
+func formatTokens(tokens int64) string {
+	switch {
+	case tokens >= 1000000:
+		return fmt.Sprintf("%.1fM", float64(tokens)/1000000)
+	case tokens >= 1000:
+		return fmt.Sprintf("%.1fk", float64(tokens)/1000)
+	}
+	return fmt.Sprintf("%d", tokens)
+}
+
+// errBudgetExceeded is returned when the user declines to go over budget
+var errBudgetExceeded = fmt.Errorf("session budget reached")
+
+// checkBudget asks the user before sending a request that could take the
+// session over its budget. Approving extends the budget by its original
+// amount; without anyone to ask, the request is refused.
+func (a *Agent) checkBudget() error {
+	_, tokens := estimateConversationTokens(a.conversation)
+	projected := a.usage.InputCost(a.config.Model, tokens)
+	if !a.usage.OverBudget(projected) {
+		return nil
+	}
+	if a.getUserMessage == nil {
+		return errBudgetExceeded
+	}
+
+	answer, ok := a.getUserMessage(fmt.Sprintf("\u001b[96mbudget\u001b[0m: The session has cost $%.4f and the next request (~$%.4f) may exceed the budget. Continue? [y/N] ",
+		a.usage.SessionCost(), projected))
+	if !ok || !strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+		return errBudgetExceeded
+	}
+	a.usage.ExtendBudget(a.config.BudgetUSD)
+	return nil
+}
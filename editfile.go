@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Most near misses suggested when old_str isn't found
+	maxEditCandidates = 3
+	// How similar, from 0 to 1, lines have to be to old_str to be suggested
+	minCandidateSimilarity = 0.6
+)
+
+var EditFileDefinition = ToolDefinition{
+	Name: "edit_file",
+	Description: `Make edits to a text file.
+
+Replaces 'old_str' with 'new_str' in the given file. 'old_str' and 'new_str' MUST be different from each other. 'old_str' must occur exactly once in the file, so include enough of the surrounding text to make it unique, or set 'replace_all' to replace every occurrence.
+
+If the file specified with path doesn't exist, it will be created.
+`,
+	InputSchema: EditFileInputSchema,
+	Function:    EditFile,
+	Concurrency: ConcurrencyWritesPath,
+}
+
+type EditFileInput struct {
+	Path       string `json:"path" jsonschema_description:"The path to the file"`
+	OldStr     string `json:"old_str" jsonschema_description:"Text to search for - must match exactly and must only have one match exactly, unless replace_all is set"`
+	NewStr     string `json:"new_str" jsonschema_description:"Text to replace old_str with"`
+	ReplaceAll bool   `json:"replace_all,omitempty" jsonschema_description:"Set to true to replace every occurrence of old_str. Defaults to false."`
+}
+
+var EditFileInputSchema = GenerateSchema[EditFileInput]()
+
+func EditFile(ctx context.Context, input json.RawMessage) (string, error) {
+	editFileInput := EditFileInput{}
+	err := json.Unmarshal(input, &editFileInput)
+	if err != nil {
+		return "", err
+	}
+
+	if editFileInput.Path == "" || editFileInput.OldStr == editFileInput.NewStr {
+		return "", fmt.Errorf("invalid input parameters")
+	}
+
+	oldContent, encoding, err := readTextFile(editFileInput.Path)
+	if err != nil {
+		if os.IsNotExist(err) && editFileInput.OldStr == "" {
+			return createNewFile(editFileInput.Path, editFileInput.NewStr)
+		}
+		return "", err
+	}
+
+	newContent, replaced, err := replaceText(oldContent, editFileInput.OldStr, editFileInput.NewStr, editFileInput.ReplaceAll)
+	if oldContent == "" && editFileInput.OldStr == "" {
+		// An empty file is filled in as if it were being created
+		newContent, err = editFileInput.NewStr, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeTextFile(editFileInput.Path, newContent, encoding); err != nil {
+		return "", err
+	}
+
+	if replaced > 1 {
+		return fmt.Sprintf("OK, replaced %d occurrences", replaced), nil
+	}
+	return "OK", nil
+}
+
+func createNewFile(filePath, content string) (string, error) {
+	dir := path.Dir(filePath)
+	if dir != "." {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return "", fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	err := os.WriteFile(filePath, []byte(content), 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return fmt.Sprintf("Successfully created file %s", filePath), nil
+}
+
+var MultiEditDefinition = ToolDefinition{
+	Name: "multi_edit",
+	Description: `Make several edits to one text file at once.
+
+The edits are applied in order, each to the result of the ones before it, with the same rules as edit_file: 'old_str' must occur exactly once unless 'replace_all' is set, and 'new_str' must differ from it. The file is only written if every edit succeeds; otherwise it is left unchanged and the failed edit is reported.
+
+To create a file, give a path that doesn't exist and an empty 'old_str' in the first edit.`,
+	InputSchema: MultiEditInputSchema,
+	Function:    MultiEdit,
+	Concurrency: ConcurrencyWritesPath,
+}
+
+type FileEdit struct {
+	OldStr     string `json:"old_str" jsonschema_description:"Text to search for - must match exactly and must only have one match exactly, unless replace_all is set"`
+	NewStr     string `json:"new_str" jsonschema_description:"Text to replace old_str with"`
+	ReplaceAll bool   `json:"replace_all,omitempty" jsonschema_description:"Set to true to replace every occurrence of old_str. Defaults to false."`
+}
+
+type MultiEditInput struct {
+	Path  string     `json:"path" jsonschema_description:"The path to the file"`
+	Edits []FileEdit `json:"edits" jsonschema_description:"The edits to make, in the order they are applied"`
+}
+
+var MultiEditInputSchema = GenerateSchema[MultiEditInput]()
+
+// MultiEdit applies a list of edits to a file in memory and writes the file
+// only if all of them succeed
+func MultiEdit(ctx context.Context, input json.RawMessage) (string, error) {
+	multiEditInput := MultiEditInput{}
+	if err := json.Unmarshal(input, &multiEditInput); err != nil {
+		return "", err
+	}
+	if multiEditInput.Path == "" || len(multiEditInput.Edits) == 0 {
+		return "", fmt.Errorf("a path and at least one edit are required")
+	}
+
+	edits := multiEditInput.Edits
+	content, encoding, err := readTextFile(multiEditInput.Path)
+	created := false
+	if os.IsNotExist(err) && edits[0].OldStr == "" {
+		// The first edit creates the file
+		content, encoding, err = edits[0].NewStr, utf8Encoding, nil
+		edits, created = edits[1:], true
+	}
+	if err != nil {
+		return "", err
+	}
+	replacements := 0
+	filled := false
+	if !created && content == "" && edits[0].OldStr == "" && edits[0].NewStr != "" {
+		// An empty file is filled in by the first edit as if it were being created
+		content = edits[0].NewStr
+		edits, filled, replacements = edits[1:], true, 1
+	}
+
+	for i, edit := range edits {
+		number := i + 1
+		if created || filled {
+			number++
+		}
+		if edit.OldStr == edit.NewStr {
+			return "", fmt.Errorf("edit %d failed, so the file was left unchanged: old_str and new_str must be different", number)
+		}
+		updated, replaced, err := replaceText(content, edit.OldStr, edit.NewStr, edit.ReplaceAll)
+		if err != nil {
+			return "", fmt.Errorf("edit %d failed, so the file was left unchanged: %w", number, err)
+		}
+		content = updated
+		replacements += replaced
+	}
+
+	if created {
+		if err := os.MkdirAll(filepath.Dir(multiEditInput.Path), 0755); err != nil {
+			return "", fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	if err := writeTextFile(multiEditInput.Path, content, encoding); err != nil {
+		return "", err
+	}
+	if created {
+		return fmt.Sprintf("Successfully created file %s with %d edits applied", multiEditInput.Path, len(multiEditInput.Edits)), nil
+	}
+	return fmt.Sprintf("OK, applied %d edits with %d replacements", len(multiEditInput.Edits), replacements), nil
+}
+
+// readTextFile reads a file for editing, converted to UTF-8. Binary files are
+// refused.
+func readTextFile(path string) (string, textEncoding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", textEncoding{}, err
+	}
+	encoding, isText := detectEncoding(data[:min(len(data), sniffLen)])
+	if !isText {
+		return "", textEncoding{}, fmt.Errorf("%s is a binary file and can't be edited", path)
+	}
+	content, err := encoding.decode(data)
+	if err != nil {
+		return "", textEncoding{}, err
+	}
+	return content, encoding, nil
+}
+
+// writeTextFile writes edited content back to a file in its original
+// encoding
+func writeTextFile(path, content string, encoding textEncoding) error {
+	data, err := encoding.encode(content)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// replaceText replaces oldStr with newStr in content. Unless replaceAll is
+// set, oldStr has to occur exactly once, so that an edit can't change more
+// than the model intended. It returns the new content and the number of
+// replacements.
+func replaceText(content, oldStr, newStr string, replaceAll bool) (string, int, error) {
+	if oldStr == "" {
+		return "", 0, fmt.Errorf("old_str cannot be empty unless the file is being created")
+	}
+	lines := matchLines(content, oldStr)
+	switch {
+	case len(lines) == 0:
+		return "", 0, fmt.Errorf("old_str not found in file%s", describeCandidates(content, oldStr))
+	case len(lines) > 1 && !replaceAll:
+		return "", 0, fmt.Errorf("old_str matches %d times, at lines %s. Include more of the surrounding text to make it unique, or set replace_all to replace every occurrence",
+			len(lines), joinLineNumbers(lines))
+	}
+	return strings.ReplaceAll(content, oldStr, newStr), len(lines), nil
+}
+
+// matchLines returns the line numbers at which the non-overlapping
+// occurrences of oldStr in content start
+func matchLines(content, oldStr string) []int {
+	lines := []int{}
+	line, searched := 1, 0
+	for {
+		i := strings.Index(content[searched:], oldStr)
+		if i < 0 {
+			return lines
+		}
+		line += strings.Count(content[searched:searched+i], "\n")
+		lines = append(lines, line)
+		line += strings.Count(oldStr, "\n")
+		searched += i + len(oldStr)
+	}
+}
+
+// joinLineNumbers lists numbers as "1, 4 and 9"
+func joinLineNumbers(numbers []int) string {
+	text := []string{}
+	for _, number := range numbers {
+		text = append(text, fmt.Sprint(number))
+	}
+	if len(text) == 1 {
+		return text[0]
+	}
+	return strings.Join(text[:len(text)-1], ", ") + " and " + text[len(text)-1]
+}
+
+// editCandidate is a run of lines of a file that resembles old_str
+type editCandidate struct {
+	// FirstLine is the 1-based number of the first line
+	FirstLine  int
+	Lines      []string
+	Similarity float64
+}
+
+// describeCandidates explains where old_str may have been meant to match, to
+// be appended to the error, or returns an empty string if nothing is close
+func describeCandidates(content, oldStr string) string {
+	candidates := findCandidates(content, oldStr)
+	if len(candidates) == 0 {
+		return ""
+	}
+	var text strings.Builder
+	text.WriteString(". The closest matches, ignoring whitespace and indentation, are:")
+	for _, candidate := range candidates {
+		lastLine := candidate.FirstLine + len(candidate.Lines) - 1
+		if lastLine == candidate.FirstLine {
+			fmt.Fprintf(&text, "\n\nLine %d:\n", candidate.FirstLine)
+		} else {
+			fmt.Fprintf(&text, "\n\nLines %d-%d:\n", candidate.FirstLine, lastLine)
+		}
+		for i, line := range candidate.Lines {
+			fmt.Fprintf(&text, "%6d\t%s\n", candidate.FirstLine+i, line)
+		}
+	}
+	return strings.TrimSuffix(text.String(), "\n") + "\n\nCopy the text exactly from the file, without the line numbers."
+}
+
+// findCandidates compares every run of as many lines as old_str has with
+// old_str, with whitespace normalized, and returns the most similar runs that
+// don't overlap
+func findCandidates(content, oldStr string) []editCandidate {
+	wanted := normalizedLines(oldStr)
+	if len(wanted) == 0 {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	normalized := make([]string, len(lines))
+	for i, line := range lines {
+		normalized[i] = normalizeSpace(line)
+	}
+
+	all := []editCandidate{}
+	for start := 0; start+len(wanted) <= len(lines); start++ {
+		total := 0.0
+		for i, line := range wanted {
+			total += similarity(normalized[start+i], line)
+		}
+		score := total / float64(len(wanted))
+		if score >= minCandidateSimilarity {
+			all = append(all, editCandidate{FirstLine: start + 1, Lines: lines[start : start+len(wanted)], Similarity: score})
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Similarity > all[j].Similarity })
+
+	candidates := []editCandidate{}
+	for _, candidate := range all {
+		overlaps := false
+		for _, chosen := range candidates {
+			if candidate.FirstLine < chosen.FirstLine+len(chosen.Lines) && chosen.FirstLine < candidate.FirstLine+len(candidate.Lines) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			candidates = append(candidates, candidate)
+		}
+		if len(candidates) == maxEditCandidates {
+			break
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].FirstLine < candidates[j].FirstLine })
+	return candidates
+}
+
+// normalizedLines splits text into lines with whitespace normalized, leaving
+// out blank lines at either end
+func normalizedLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = normalizeSpace(line)
+	}
+	return lines
+}
+
+// normalizeSpace trims s and collapses its runs of whitespace into a space
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// similarity scores how alike two strings are from 0 to 1, using the share
+// of character pairs they have in common (the Sørensen–Dice coefficient)
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	if len(a) < 2 || len(b) < 2 {
+		return 0
+	}
+	pairs := map[string]int{}
+	for i := 0; i+1 < len(a); i++ {
+		pairs[a[i:i+2]]++
+	}
+	shared := 0
+	for i := 0; i+1 < len(b); i++ {
+		if pairs[b[i:i+2]] > 0 {
+			pairs[b[i:i+2]]--
+			shared++
+		}
+	}
+	return 2 * float64(shared) / float64(len(a)+len(b)-2)
+}
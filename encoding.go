@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// How much of the beginning of a file is inspected to tell text from binary
+// and guess the encoding
+const sniffLen = 8 * 1024
+
+// textEncoding is the character encoding of a text file
+type textEncoding struct {
+	// Name is how the encoding is described to the model
+	Name string
+	// encoding converts from and to UTF-8, or is nil for UTF-8 itself
+	encoding encoding.Encoding
+}
+
+var utf8Encoding = textEncoding{Name: "UTF-8"}
+
+// Byte order marks and the encodings they announce
+var byteOrderMarks = []struct {
+	bom      string
+	encoding textEncoding
+}{
+	{"\xef\xbb\xbf", textEncoding{"UTF-8 with BOM", unicode.UTF8BOM}},
+	{"\xff\xfe", textEncoding{"UTF-16LE with BOM", unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)}},
+	{"\xfe\xff", textEncoding{"UTF-16BE with BOM", unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)}},
+}
+
+// Signatures of common binary formats, reported to help the model decide
+// how to inspect a file it can't read
+var fileSignatures = []struct {
+	magic  string
+	format string
+}{
+	{"\x7fELF", "ELF executable"},
+	{"MZ", "Windows executable"},
+	{"\xcf\xfa\xed\xfe", "Mach-O executable"},
+	{"\xca\xfe\xba\xbe", "Java class file or Mach-O universal binary"},
+	{"\x00asm", "WebAssembly module"},
+	{"PK\x03\x04", "zip archive"},
+	{"\x1f\x8b", "gzip archive"},
+	{"BZh", "bzip2 archive"},
+	{"\xfd7zXZ\x00", "xz archive"},
+	{"\x28\xb5\x2f\xfd", "zstd archive"},
+	{"7z\xbc\xaf\x27\x1c", "7-Zip archive"},
+	{"%PDF-", "PDF document"},
+	{"SQLite format 3\x00", "SQLite database"},
+}
+
+// detectEncoding guesses the encoding of a file from its beginning. It
+// reports false if the file looks binary rather than like text. Text that
+// isn't valid UTF-8 is taken to be windows-1252, which covers Latin-1.
+func detectEncoding(head []byte) (textEncoding, bool) {
+	for _, mark := range byteOrderMarks {
+		if bytes.HasPrefix(head, []byte(mark.bom)) {
+			return mark.encoding, true
+		}
+	}
+	if encoding, ok := detectUTF16(head); ok {
+		return encoding, true
+	}
+	if looksBinary(head) {
+		return textEncoding{}, false
+	}
+	if utf8.Valid(trimIncompleteRune(head)) {
+		return utf8Encoding, true
+	}
+	return textEncoding{"windows-1252", charmap.Windows1252}, true
+}
+
+// detectUTF16 recognizes UTF-16 without a byte order mark by its zero bytes,
+// which mostly text in Latin script has in every other position
+func detectUTF16(head []byte) (textEncoding, bool) {
+	pairs := len(head) / 2
+	if pairs < 2 {
+		return textEncoding{}, false
+	}
+	evenZeros, oddZeros := 0, 0
+	for i := 0; i+1 < len(head); i += 2 {
+		if head[i] == 0 {
+			evenZeros++
+		}
+		if head[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	switch {
+	case evenZeros == 0 && oddZeros >= pairs/2:
+		return textEncoding{"UTF-16LE", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)}, true
+	case oddZeros == 0 && evenZeros >= pairs/2:
+		return textEncoding{"UTF-16BE", unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)}, true
+	}
+	return textEncoding{}, false
+}
+
+// looksBinary reports whether data has zero bytes or more control characters
+// than text plausibly would
+func looksBinary(data []byte) bool {
+	controls := 0
+	for _, b := range data {
+		switch {
+		case b == 0:
+			return true
+		case b == '\t' || b == '\n' || b == '\r' || b == '\f' || b == '\v' || b == '\b' || b == 0x1b:
+		case b < 0x20 || b == 0x7f:
+			controls++
+		}
+	}
+	return controls > len(data)/10
+}
+
+// trimIncompleteRune drops a character cut in half at the end of data, as
+// happens when only the beginning of a file is read
+func trimIncompleteRune(data []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// reader converts text read from r to UTF-8
+func (e textEncoding) reader(r io.Reader) io.Reader {
+	if e.encoding == nil {
+		return r
+	}
+	return transform.NewReader(r, e.encoding.NewDecoder())
+}
+
+// decode converts data to UTF-8
+func (e textEncoding) decode(data []byte) (string, error) {
+	if e.encoding == nil {
+		return string(data), nil
+	}
+	decoded, err := e.encoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s text: %w", e.Name, err)
+	}
+	return string(decoded), nil
+}
+
+// encode converts UTF-8 text back to the encoding, failing if the text has
+// characters the encoding can't represent
+func (e textEncoding) encode(text string) ([]byte, error) {
+	if e.encoding == nil {
+		return []byte(text), nil
+	}
+	encoded, err := e.encoding.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("the file is encoded as %s, which can't represent the new text: %w", e.Name, err)
+	}
+	return encoded, nil
+}
+
+// notice tells the model that the text it sees was converted, or returns an
+// empty string for UTF-8
+func (e textEncoding) notice() string {
+	if e.encoding == nil {
+		return ""
+	}
+	return fmt.Sprintf("[The file is encoded as %s and was converted to UTF-8. edit_file and multi_edit write it back as %s.]", e.Name, e.Name)
+}
+
+// describeBinary summarizes a binary file in place of its contents
+func describeBinary(name string, size int64, head []byte) string {
+	mediaType := http.DetectContentType(head)
+	if strings.HasPrefix(mediaType, "text/") {
+		mediaType = "application/octet-stream"
+	}
+	description := fmt.Sprintf("%s is a binary file and wasn't read: %d bytes, %s", name, size, mediaType)
+	for _, signature := range fileSignatures {
+		if bytes.HasPrefix(head, []byte(signature.magic)) {
+			description += ", " + signature.format
+			break
+		}
+	}
+	magic := head[:min(len(head), 16)]
+	description += fmt.Sprintf(".\nFirst bytes: % x\n", magic)
+	return description + "Use execute with a suitable command, such as file, xxd or unzip -l, to inspect it."
+}
@@ -5,6 +5,9 @@ go 1.24.1
 require (
 	github.com/anthropics/anthropic-sdk-go v0.2.0-beta.3
 	github.com/invopop/jsonschema v0.13.0
+	golang.org/x/image v0.25.0
+	golang.org/x/term v0.32.0
+	golang.org/x/text v0.23.0
 )
 
 require (
@@ -16,5 +19,6 @@ require (
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
 	github.com/wk8/go-ordered-map/v2 v2.1.8 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Exit codes of a headless run
+const (
+	exitSuccess     = 0
+	exitError       = 1
+	exitUsage       = 2
+	exitMaxTurns    = 3
+	exitInterrupted = 130
+)
+
+// Output formats of a headless run
+const (
+	// outputText prints only the final response text
+	outputText = "text"
+	// outputJSON prints a single HeadlessResult object
+	outputJSON = "json"
+	// outputStreamJSON prints one HeadlessEvent per line as the run progresses
+	outputStreamJSON = "stream-json"
+)
+
+// HeadlessResult summarizes a headless run
+type HeadlessResult struct {
+	Type string `json:"type"`
+	// Subtype is one of "success", "error_max_turns", "error" or "interrupted"
+	Subtype      string     `json:"subtype"`
+	IsError      bool       `json:"is_error"`
+	Result       string     `json:"result"`
+	Error        string     `json:"error,omitempty"`
+	NumTurns     int        `json:"num_turns"`
+	DurationMs   int64      `json:"duration_ms"`
+	TotalCostUSD float64    `json:"total_cost_usd"`
+	Usage        TokenUsage `json:"usage"`
+	SessionID    string     `json:"session_id,omitempty"`
+}
+
+// ExitCode maps the outcome of the run to the process exit status
+func (r HeadlessResult) ExitCode() int {
+	switch r.Subtype {
+	case "success":
+		return exitSuccess
+	case "error_max_turns":
+		return exitMaxTurns
+	case "interrupted":
+		return exitInterrupted
+	}
+	return exitError
+}
+
+// HeadlessEvent is a single line of stream-json output. Which fields are set
+// depends on the event type: "init", "message", "tool_call" or "result".
+type HeadlessEvent struct {
+	Type       string                  `json:"type"`
+	SessionID  string                  `json:"session_id,omitempty"`
+	Model      string                  `json:"model,omitempty"`
+	Tools      []string                `json:"tools,omitempty"`
+	Message    *anthropic.MessageParam `json:"message,omitempty"`
+	ToolUseID  string                  `json:"tool_use_id,omitempty"`
+	Name       string                  `json:"name,omitempty"`
+	Input      json.RawMessage         `json:"input,omitempty"`
+	IsError    bool                    `json:"is_error,omitempty"`
+	DurationMs int64                   `json:"duration_ms,omitempty"`
+}
+
+// eventWriter writes stream-json events. Tool calls finish concurrently, so
+// writes are serialized.
+type eventWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (w *eventWriter) write(event any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.encoder.Encode(event)
+}
+
+// RunHeadless sends a single prompt and runs the tool loop until the model
+// ends its turn or maxTurns responses have been generated (zero means no
+// limit). Progress and the result are written to out in the given format.
+func (a *Agent) RunHeadless(ctx context.Context, prompt string, format string, maxTurns int, out io.Writer) HeadlessResult {
+	start := time.Now()
+	result := HeadlessResult{Type: "result"}
+	if a.session != nil {
+		result.SessionID = a.session.ID
+	}
+
+	// Nothing is streamed to the terminal; output only goes to out. There
+	// is nobody to ask either, so the budget is a hard limit.
+	a.streamHandler = nil
+	a.getUserMessage = nil
+	if format == outputStreamJSON {
+		writer := &eventWriter{encoder: json.NewEncoder(out)}
+		a.onEvent = func(event HeadlessEvent) { writer.write(event) }
+
+		toolNames := []string{}
+		for _, tool := range a.activeTools() {
+			toolNames = append(toolNames, tool.Name)
+		}
+		a.emit(HeadlessEvent{Type: "init", SessionID: result.SessionID, Model: a.config.Model, Tools: toolNames})
+	}
+
+	// User commands work as prompts too; the built-ins need a terminal
+	if match := commandName.FindStringSubmatch(strings.TrimSpace(prompt)); match != nil {
+		if command, ok := a.findCommand(match[1]); ok && command.Source != "" {
+			prompt, _, _ = a.handleCommand(ctx, prompt)
+		}
+	}
+
+	a.appendMessage(newUserMessage(a.out, prompt))
+	for {
+		if maxTurns > 0 && result.NumTurns >= maxTurns {
+			result.Subtype = "error_max_turns"
+			result.Error = fmt.Sprintf("reached the maximum of %d turns", maxTurns)
+			break
+		}
+
+		stepCtx, endStep := a.beginStep(ctx)
+		needsReply, err := a.step(stepCtx)
+		interrupted := stepCtx.Err() != nil
+		endStep()
+		result.NumTurns++
+
+		if interrupted {
+			result.Subtype = "interrupted"
+			result.Error = "interrupted by user"
+			break
+		}
+		if err != nil {
+			result.Subtype = "error"
+			result.Error = err.Error()
+			break
+		}
+		if !needsReply {
+			result.Subtype = "success"
+			break
+		}
+	}
+
+	result.IsError = result.Subtype != "success"
+	result.Result = a.lastResponseText()
+	result.DurationMs = time.Since(start).Milliseconds()
+	result.TotalCostUSD = a.usage.SessionCost()
+	result.Usage = a.usage.SessionUsage()
+
+	switch format {
+	case outputJSON, outputStreamJSON:
+		json.NewEncoder(out).Encode(result)
+	default:
+		if result.Result != "" {
+			fmt.Fprintln(out, result.Result)
+		}
+	}
+	return result
+}
+
+// emit reports an event to the headless output, if there is one
+func (a *Agent) emit(event HeadlessEvent) {
+	if a.onEvent != nil {
+		a.onEvent(event)
+	}
+}
+
+// lastResponseText returns the text of the most recent assistant message
+func (a *Agent) lastResponseText() string {
+	for i := len(a.conversation) - 1; i >= 0; i-- {
+		message := a.conversation[i]
+		if message.Role != anthropic.MessageParamRoleAssistant {
+			continue
+		}
+		var text strings.Builder
+		for _, block := range message.Content {
+			if block.OfRequestTextBlock != nil {
+				text.WriteString(block.OfRequestTextBlock.Text)
+			}
+		}
+		return text.String()
+	}
+	return ""
+}
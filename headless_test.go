@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHeadlessStreamJSON(t *testing.T) {
+	useWorkspace(t, map[string]string{"notes.txt": "remember the milk\n", "photo.png": "not really a png"})
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{
+			{"read_file", map[string]any{"path": "notes.txt"}},
+			{"summon_file", map[string]any{"path": "notes.txt"}},
+		}},
+		Turn{
+			Expect: []Result{{Contains: "remember the milk"}, {Contains: "tool not found", IsError: true}},
+			Text:   "You need milk.",
+		},
+	)
+	agent := NewAgent(provider, nil, builtinTools, DefaultConfig(), "")
+	var out, status strings.Builder
+	agent.out = &status
+	// The prompt names an image that can't be attached, which is reported
+	// to the user rather than in the output
+	result := agent.RunHeadless(t.Context(), "What's in my notes? See photo.png", outputStreamJSON, 0, &out)
+	if result.Subtype != "success" || result.Result != "You need milk." {
+		t.Errorf("headless run = %+v", result)
+	}
+	if !strings.Contains(status.String(), "Not attaching photo.png") {
+		t.Errorf("the skipped image wasn't reported: %q", status.String())
+	}
+
+	toolCalls := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event HeadlessEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("output line %q isn't an event: %v", line, err)
+		}
+		if event.Type == "tool_call" {
+			toolCalls[event.Name] = event.IsError
+		}
+	}
+	if len(toolCalls) != 2 || toolCalls["read_file"] || !toolCalls["summon_file"] {
+		t.Errorf("tool_call events = %v, want read_file and a failed summon_file", toolCalls)
+	}
+}
+
+func TestAgentOutputGoesToItsWriter(t *testing.T) {
+	useWorkspace(t, nil)
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{{"task", map[string]any{"prompt": "Look around"}}}},
+		Turn{Text: "Nothing here."},
+		Turn{Expect: []Result{{Contains: "Nothing here."}}, Text: "All done."},
+	)
+	agent := NewAgent(provider, answering("Explore"), builtinTools, DefaultConfig(), "")
+	agent.EnableTasks()
+	var out strings.Builder
+	agent.out = &out
+	runAgent(t, agent)
+
+	// Both the streamed response and the sub-agent's nested progress
+	for _, want := range []string{"All done.", "[task 1]\u001b[0m Started", "Nothing here."} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// The API rejects images whose base64 encoding is larger than this
+	maxImageEncodedBytes = 5 * 1024 * 1024
+	// Images with a longer edge are scaled down. The API would otherwise do
+	// it itself, after charging for the upload.
+	maxImageDimension = 1568
+	// Rough token cost of an image at the maximum size, used where the
+	// dimensions aren't known
+	imageTokenEstimate = 1600
+)
+
+// Extensions of the image files that are attached when named in a prompt
+var imageExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true}
+
+// promptWord matches a quoted string or a run of non-space characters in
+// which spaces may be escaped with a backslash, as terminals do when a file
+// is dropped onto them
+var promptWord = regexp.MustCompile(`"[^"]+"|'[^']+'|(?:\\ |\S)+`)
+
+// Image is an image ready to be sent to the model
+type Image struct {
+	MediaType string
+	Data      []byte
+	Width     int
+	Height    int
+	// OriginalWidth and OriginalHeight differ from Width and Height if the
+	// image was scaled down
+	OriginalWidth  int
+	OriginalHeight int
+}
+
+// imageMediaType returns the media type of data if it is an image in one of
+// the formats the API accepts
+func imageMediaType(data []byte) (string, bool) {
+	switch mediaType := http.DetectContentType(data); mediaType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return mediaType, true
+	}
+	return "", false
+}
+
+// loadImage prepares an image for the API, scaling it down if it exceeds
+// the size limits. Images within the limits are sent unchanged.
+func loadImage(data []byte, mediaType string) (Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+	result := Image{
+		MediaType:      mediaType,
+		Data:           data,
+		Width:          config.Width,
+		Height:         config.Height,
+		OriginalWidth:  config.Width,
+		OriginalHeight: config.Height,
+	}
+	if result.fits() {
+		return result, nil
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+	// Shrink until the encoded image is small enough too
+	longest := max(config.Width, config.Height)
+	target := min(longest, maxImageDimension)
+	for target > 0 {
+		width := max(1, config.Width*target/longest)
+		height := max(1, config.Height*target/longest)
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), decoded, decoded.Bounds(), draw.Src, nil)
+
+		var encoded bytes.Buffer
+		// Lossless formats stay lossless; photos are re-encoded as JPEG
+		if mediaType == "image/png" || mediaType == "image/gif" {
+			result.MediaType = "image/png"
+			err = png.Encode(&encoded, scaled)
+		} else {
+			result.MediaType = "image/jpeg"
+			err = jpeg.Encode(&encoded, scaled, &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return Image{}, fmt.Errorf("failed to encode scaled image: %w", err)
+		}
+		result.Data, result.Width, result.Height = encoded.Bytes(), width, height
+		if result.fits() {
+			return result, nil
+		}
+		target = target * 3 / 4
+	}
+	return Image{}, fmt.Errorf("image is too large to send even when scaled down")
+}
+
+// fits reports whether the image is within the API's limits
+func (i Image) fits() bool {
+	return i.Width <= maxImageDimension && i.Height <= maxImageDimension &&
+		base64.StdEncoding.EncodedLen(len(i.Data)) <= maxImageEncodedBytes
+}
+
+// Describe summarizes the image for the text that accompanies it
+func (i Image) Describe(name string) string {
+	description := fmt.Sprintf("%s (%s, %dx%d", name, i.MediaType, i.Width, i.Height)
+	if i.Width != i.OriginalWidth || i.Height != i.OriginalHeight {
+		description += fmt.Sprintf(", scaled down from %dx%d", i.OriginalWidth, i.OriginalHeight)
+	}
+	return description + ")"
+}
+
+// EstimatedTokens approximates the image's token cost as the API documents
+// it: one token per 750 pixels
+func (i Image) EstimatedTokens() int {
+	return i.Width*i.Height/750 + 1
+}
+
+func (i Image) blockParam() *anthropic.ImageBlockParam {
+	return anthropic.NewImageBlockBase64(i.MediaType, base64.StdEncoding.EncodeToString(i.Data)).OfRequestImageBlock
+}
+
+// readImageFile loads an image file if it is in a format the API accepts.
+// It reports false for files that aren't images.
+func readImageFile(path string) (Image, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Image{}, false, err
+	}
+	mediaType, ok := imageMediaType(data)
+	if !ok {
+		return Image{}, false, nil
+	}
+	image, err := loadImage(data, mediaType)
+	return image, true, err
+}
+
+// newUserMessage creates the message for what the user typed, attaching the
+// image files it names. Paths may be quoted, have escaped spaces or be
+// prefixed with @; other words are left alone. Attached and skipped images are
+// reported to out.
+func newUserMessage(out io.Writer, input string) anthropic.MessageParam {
+	blocks := []anthropic.ContentBlockParamUnion{}
+	attached := map[string]bool{}
+	for _, word := range promptWord.FindAllString(input, -1) {
+		path := strings.TrimPrefix(word, "@")
+		if len(path) >= 2 && (path[0] == '"' || path[0] == '\'') && path[len(path)-1] == path[0] {
+			path = path[1 : len(path)-1]
+		} else {
+			// Punctuation after a path belongs to the sentence
+			path = strings.TrimRight(path, ".,;:!?)")
+		}
+		path = strings.ReplaceAll(path, `\ `, " ")
+		if !imageExtensions[strings.ToLower(filepath.Ext(path))] || attached[path] {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		image, isImage, err := readImageFile(path)
+		if err == nil && !isImage {
+			err = fmt.Errorf("not a png, jpeg, gif or webp image")
+		}
+		if err != nil {
+			fmt.Fprintf(out, "Warning: Not attaching %s: %v\n", path, err)
+			continue
+		}
+		attached[path] = true
+		blocks = append(blocks, anthropic.ContentBlockParamUnion{OfRequestImageBlock: image.blockParam()})
+		fmt.Fprintf(out, "\u001b[96minfo\u001b[0m: Attached image %s\n", image.Describe(path))
+	}
+	// Images come first, which is what the API recommends
+	return anthropic.NewUserMessage(append(blocks, anthropic.NewTextBlock(input))...)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"testing"
+)
+
+// encodeTestImage draws a gradient so that the image doesn't compress to
+// nothing, and encodes it as PNG or JPEG
+func encodeTestImage(t *testing.T, width, height int, format string) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	var buffer bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buffer, img)
+	} else {
+		err = jpeg.Encode(&buffer, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestLoadImage(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		mediaType     string
+		width, height int
+		unchanged     bool
+	}{
+		{"small png", encodeTestImage(t, 64, 32, "png"), "image/png", 64, 32, true},
+		{"wide png", encodeTestImage(t, 3136, 200, "png"), "image/png", 1568, 100, false},
+		{"tall jpeg", encodeTestImage(t, 400, 2000, "jpeg"), "image/jpeg", 313, 1568, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mediaType, ok := imageMediaType(test.data)
+			if !ok || mediaType != test.mediaType {
+				t.Fatalf("imageMediaType = %q, %v, want %q", mediaType, ok, test.mediaType)
+			}
+			loaded, err := loadImage(test.data, mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.MediaType != test.mediaType || loaded.Width != test.width || loaded.Height != test.height {
+				t.Errorf("got %s %dx%d, want %s %dx%d", loaded.MediaType, loaded.Width, loaded.Height, test.mediaType, test.width, test.height)
+			}
+			if unchanged := bytes.Equal(loaded.Data, test.data); unchanged != test.unchanged {
+				t.Errorf("data unchanged = %v, want %v", unchanged, test.unchanged)
+			}
+			if decoded, _, err := image.DecodeConfig(bytes.NewReader(loaded.Data)); err != nil || decoded.Width != test.width {
+				t.Errorf("encoded image is %dx%d (%v)", decoded.Width, decoded.Height, err)
+			}
+		})
+	}
+
+	if _, ok := imageMediaType([]byte("just text")); ok {
+		t.Error("text was detected as an image")
+	}
+	if _, err := loadImage([]byte("\x89PNG\r\n\x1a\ntruncated"), "image/png"); err == nil {
+		t.Error("expected an error for a corrupt image")
+	}
+}
+
+func TestNewUserMessageAttachesImages(t *testing.T) {
+	screenshot := encodeTestImage(t, 10, 10, "png")
+	useWorkspace(t, map[string]string{
+		"screenshot.png":   string(screenshot),
+		"my diagram.png":   string(encodeTestImage(t, 20, 10, "png")),
+		"not-an-image.png": "hello",
+		"notes.txt":        "text",
+	})
+
+	message := newUserMessage(io.Discard, `What's wrong in @screenshot.png and my\ diagram.png? Compare with "screenshot.png", missing.png and notes.txt`)
+	if len(message.Content) != 3 {
+		t.Fatalf("got %d blocks, want two images and the text", len(message.Content))
+	}
+	first := message.Content[0].OfRequestImageBlock
+	if first == nil || first.Source.OfBase64ImageSource.Data != base64.StdEncoding.EncodeToString(screenshot) {
+		t.Error("screenshot.png wasn't attached first")
+	}
+	if message.Content[1].OfRequestImageBlock == nil {
+		t.Error("the path with an escaped space wasn't attached")
+	}
+	if text := message.Content[2].OfRequestTextBlock; text == nil || text.Text[:6] != "What's" {
+		t.Error("the prompt text should come after the images")
+	}
+
+	if plain := newUserMessage(io.Discard, "no images here"); len(plain.Content) != 1 {
+		t.Errorf("got %d blocks for a prompt without images", len(plain.Content))
+	}
+}
+
+func TestReadFileImage(t *testing.T) {
+	useWorkspace(t, map[string]string{"logo.png": string(encodeTestImage(t, 2000, 1000, "png"))})
+	if err := os.WriteFile("broken.gif", []byte("GIF89a broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runScript(t, builtinTools, "What does the logo look like?",
+		Turn{Calls: []Call{
+			{"read_file", map[string]any{"path": "logo.png"}},
+			{"read_file", map[string]any{"path": "broken.gif"}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "Image logo.png (image/png, 1568x784, scaled down from 2000x1000)", Images: 1},
+				{Contains: "failed to decode image", IsError: true},
+			},
+			Text: "A gradient.",
+		},
+	)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// Two interrupts within this window exit the program
+const doubleInterruptWindow = 2 * time.Second
+
+// Message sent back as the result of tool calls that were interrupted
+const interruptedToolResult = "Interrupted by user"
+
+// beginStep derives a cancellable context for one round of inference and tool
+// calls, so that Interrupt can stop it without ending the session.
+func (a *Agent) beginStep(ctx context.Context) (context.Context, context.CancelFunc) {
+	stepCtx, cancel := context.WithCancel(ctx)
+	a.mu.Lock()
+	a.cancelStep = cancel
+	a.mu.Unlock()
+
+	return stepCtx, func() {
+		a.mu.Lock()
+		a.cancelStep = nil
+		a.mu.Unlock()
+		cancel()
+	}
+}
+
+// Interrupt cancels the in-flight inference or tool call. It reports whether
+// there was anything to cancel.
+func (a *Agent) Interrupt() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cancelStep == nil {
+		return false
+	}
+	a.cancelStep()
+	a.cancelStep = nil
+	return true
+}
+
+// Interrupter turns Ctrl-C into a request to interrupt the agent. A second
+// Ctrl-C in quick succession calls exit instead.
+type Interrupter struct {
+	agent *Agent
+	exit  func()
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// Interrupt handles a single Ctrl-C press
+func (i *Interrupter) Interrupt() {
+	i.mu.Lock()
+	double := time.Since(i.last) < doubleInterruptWindow
+	i.last = time.Now()
+	i.mu.Unlock()
+
+	if double {
+		fmt.Fprintln(i.agent.out)
+		i.exit()
+		return
+	}
+	if i.agent.Interrupt() {
+		fmt.Fprintln(i.agent.out, "\n\u001b[96minfo\u001b[0m: Interrupted. Press Ctrl-C again to exit.")
+	} else {
+		fmt.Fprint(i.agent.out, "\n\u001b[96minfo\u001b[0m: Press Ctrl-C again to exit.\n" + userPrompt)
+	}
+}
+
+// handleInterrupts passes SIGINT on to an Interrupter, which is returned so
+// that Ctrl-C can also be reported by other means, e.g. by the line editor.
+func handleInterrupts(agent *Agent, exit func()) *Interrupter {
+	interrupter := &Interrupter{agent: agent, exit: exit}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		for range signals {
+			interrupter.Interrupt()
+		}
+	}()
+	return interrupter
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+// Number of entries kept in the history file
+const maxHistoryEntries = 1000
+
+// Terminal control sequences used by the editor
+const (
+	enableBracketedPaste  = "\x1b[?2004h"
+	disableBracketedPaste = "\x1b[?2004l"
+	pasteStart            = "200~"
+	pasteEnd              = "\x1b[201~"
+	clearToEndOfScreen    = "\x1b[J"
+)
+
+// ansiEscape matches the colour codes in prompts, which take up no columns
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// LineEditor reads user input. On a terminal it supports cursor movement,
+// multi-line entry, bracketed paste, history and reverse history search.
+// Otherwise lines are read as they come, without a length limit.
+//
+// Keys: Enter submits, unless the line ends with a backslash; Alt-Enter and
+// Ctrl-J insert a newline; Up and Down move between lines and then through
+// the history; Ctrl-R searches the history (Ctrl-G cancels); Ctrl-A, Ctrl-E,
+// Ctrl-K, Ctrl-U and Ctrl-W edit like a shell; Ctrl-D on an empty line ends
+// the input.
+type LineEditor struct {
+	in     *os.File
+	out    io.Writer
+	reader *bufio.Reader
+
+	history     []string
+	historyPath string
+
+	// OnInterrupt is called for Ctrl-C on an empty line, since the terminal
+	// doesn't raise SIGINT while the editor has it in raw mode
+	OnInterrupt func()
+	// HistoryPrompt, if set, is the only prompt whose entries are added to
+	// the history, so that answers to questions like confirmations aren't
+	HistoryPrompt string
+
+	// State of the line being edited
+	prompt     string
+	buffer     []rune
+	cursor     int
+	cursorRow  int
+	historyPos int
+	draft      []rune
+}
+
+// NewLineEditor creates an editor reading from stdin and echoing to out.
+// History is loaded from and appended to historyPath, unless it is empty.
+func NewLineEditor(out io.Writer, historyPath string) *LineEditor {
+	editor := &LineEditor{
+		in:          os.Stdin,
+		out:         out,
+		reader:      bufio.NewReader(os.Stdin),
+		historyPath: historyPath,
+	}
+	if historyPath != "" {
+		history, err := loadHistory(historyPath)
+		if err != nil {
+			fmt.Fprintf(out, "Warning: Failed to load history: %v\n", err)
+		}
+		editor.history = history
+	}
+	return editor
+}
+
+// defaultHistoryPath is the history file shared by every project
+func defaultHistoryPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "agent", "history")
+}
+
+// ReadLine shows the prompt and returns the entered text. It reports false
+// once the input has ended.
+func (e *LineEditor) ReadLine(prompt string) (string, bool) {
+	fd := int(e.in.Fd())
+	if !term.IsTerminal(fd) {
+		fmt.Fprint(e.out, prompt)
+		return e.readPlain()
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fmt.Fprint(e.out, prompt)
+		return e.readPlain()
+	}
+	fmt.Fprint(e.out, enableBracketedPaste)
+	defer func() {
+		fmt.Fprint(e.out, disableBracketedPaste)
+		term.Restore(fd, state)
+	}()
+
+	e.prompt = prompt
+	e.buffer = nil
+	e.cursor = 0
+	e.cursorRow = 0
+	e.historyPos = len(e.history)
+	e.draft = nil
+	e.render()
+
+	line, ok := e.edit(fd, state)
+	if ok && (e.HistoryPrompt == "" || prompt == e.HistoryPrompt) {
+		e.addHistory(line)
+	}
+	return line, ok
+}
+
+// readPlain reads a line from non-terminal input. A trailing backslash
+// continues the entry on the next line.
+func (e *LineEditor) readPlain() (string, bool) {
+	var lines []string
+	for {
+		line, err := e.reader.ReadString('\n')
+		if err != nil && line == "" {
+			if len(lines) > 0 {
+				return strings.Join(lines, "\n"), true
+			}
+			return "", false
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if continued, ok := strings.CutSuffix(line, "\\"); ok && err == nil {
+			lines = append(lines, continued)
+			continue
+		}
+		return strings.Join(append(lines, line), "\n"), true
+	}
+}
+
+// edit processes keys until the entry is submitted or the input ends
+func (e *LineEditor) edit(fd int, state *term.State) (string, bool) {
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			e.finish()
+			return "", false
+		}
+
+		switch r {
+		case '\r':
+			if len(e.buffer) > 0 && e.buffer[len(e.buffer)-1] == '\\' {
+				// Line continuation
+				e.buffer[len(e.buffer)-1] = '\n'
+				e.cursor = len(e.buffer)
+				break
+			}
+			e.finish()
+			return string(e.buffer), true
+		case '\n': // Ctrl-J
+			e.insert('\n')
+		case 1: // Ctrl-A
+			e.cursor = e.lineStart()
+		case 5: // Ctrl-E
+			e.cursor = e.lineEnd()
+		case 2: // Ctrl-B
+			e.moveLeft()
+		case 6: // Ctrl-F
+			e.moveRight()
+		case 3: // Ctrl-C
+			if len(e.buffer) > 0 {
+				e.buffer, e.cursor = nil, 0
+				break
+			}
+			if e.OnInterrupt != nil {
+				e.finish()
+				fmt.Fprint(e.out, disableBracketedPaste)
+				term.Restore(fd, state)
+				e.OnInterrupt()
+				term.MakeRaw(fd)
+				fmt.Fprint(e.out, enableBracketedPaste)
+				e.cursorRow = 0
+			}
+		case 4: // Ctrl-D
+			if len(e.buffer) == 0 {
+				e.finish()
+				return "", false
+			}
+			e.deleteForward()
+		case 8, 127: // Backspace
+			if e.cursor > 0 {
+				e.cursor--
+				e.deleteForward()
+			}
+		case 11: // Ctrl-K
+			e.buffer = append(e.buffer[:e.cursor:e.cursor], e.buffer[e.lineEnd():]...)
+		case 21: // Ctrl-U
+			start := e.lineStart()
+			e.buffer = append(e.buffer[:start:start], e.buffer[e.cursor:]...)
+			e.cursor = start
+		case 23: // Ctrl-W
+			start := e.wordStart()
+			e.buffer = append(e.buffer[:start:start], e.buffer[e.cursor:]...)
+			e.cursor = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+			e.cursorRow = 0
+		case 16: // Ctrl-P
+			e.moveUp()
+		case 14: // Ctrl-N
+			e.moveDown()
+		case 18: // Ctrl-R
+			if line, submit := e.search(); submit {
+				e.finish()
+				return line, true
+			}
+		case 27:
+			e.escape()
+		default:
+			if unicode.IsPrint(r) || r == '\t' {
+				e.insert(r)
+			}
+		}
+		// Typed ahead input is handled before redrawing
+		if e.reader.Buffered() == 0 {
+			e.render()
+		}
+	}
+}
+
+// escape handles the key sequences that start with ESC
+func (e *LineEditor) escape() {
+	next, _, err := e.reader.ReadRune()
+	if err != nil {
+		return
+	}
+	switch next {
+	case '\r': // Alt-Enter
+		e.insert('\n')
+	case 'b':
+		e.cursor = e.wordStart()
+	case 'f':
+		e.cursor = e.wordEnd()
+	case 'O':
+		final, _, _ := e.reader.ReadRune()
+		e.cursorKey(string(final))
+	case '[':
+		var sequence strings.Builder
+		for {
+			r, _, err := e.reader.ReadRune()
+			if err != nil {
+				return
+			}
+			sequence.WriteRune(r)
+			if r >= 0x40 && r <= 0x7e {
+				break
+			}
+		}
+		if sequence.String() == pasteStart {
+			e.paste()
+			return
+		}
+		e.cursorKey(sequence.String())
+	}
+}
+
+// cursorKey handles the final part of a cursor key sequence
+func (e *LineEditor) cursorKey(sequence string) {
+	switch sequence {
+	case "A":
+		e.moveUp()
+	case "B":
+		e.moveDown()
+	case "C":
+		e.moveRight()
+	case "D":
+		e.moveLeft()
+	case "H", "1~", "7~":
+		e.cursor = e.lineStart()
+	case "F", "4~", "8~":
+		e.cursor = e.lineEnd()
+	case "3~":
+		e.deleteForward()
+	case "1;5C", "1;3C":
+		e.cursor = e.wordEnd()
+	case "1;5D", "1;3D":
+		e.cursor = e.wordStart()
+	}
+}
+
+// paste inserts bracketed paste content as is, so that pasted newlines don't
+// submit the entry
+func (e *LineEditor) paste() {
+	var pasted strings.Builder
+	for !strings.HasSuffix(pasted.String(), pasteEnd) {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			break
+		}
+		pasted.WriteRune(r)
+	}
+	text := strings.TrimSuffix(pasted.String(), pasteEnd)
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+	for _, r := range text {
+		e.insert(r)
+	}
+}
+
+// search runs a reverse incremental search through the history. Enter
+// submits the match, Ctrl-R looks for an older match, Ctrl-G cancels and any
+// other key keeps the match for editing.
+func (e *LineEditor) search() (string, bool) {
+	saved, savedCursor := e.buffer, e.cursor
+	query := []rune{}
+	position := len(e.history)
+	match := ""
+
+	find := func(from int) {
+		for i := from - 1; i >= 0; i-- {
+			if strings.Contains(e.history[i], string(query)) {
+				position, match = i, e.history[i]
+				return
+			}
+		}
+	}
+
+	for {
+		e.buffer = []rune(match)
+		e.cursor = len(e.buffer)
+		e.renderWithPrompt(fmt.Sprintf("(reverse-i-search)`%s': ", string(query)))
+
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", false
+		}
+		switch {
+		case r == '\r':
+			return match, true
+		case r == 18: // Ctrl-R
+			find(position)
+		case r == 7 || r == 3: // Ctrl-G, Ctrl-C
+			e.buffer, e.cursor = saved, savedCursor
+			return "", false
+		case r == 8 || r == 127:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				position, match = len(e.history), ""
+				find(position)
+			}
+		case unicode.IsPrint(r):
+			query = append(query, r)
+			if !strings.Contains(match, string(query)) {
+				find(min(position+1, len(e.history)))
+			}
+		default:
+			return "", false
+		}
+	}
+}
+
+func (e *LineEditor) insert(r rune) {
+	e.buffer = append(e.buffer[:e.cursor], append([]rune{r}, e.buffer[e.cursor:]...)...)
+	e.cursor++
+}
+
+func (e *LineEditor) deleteForward() {
+	if e.cursor < len(e.buffer) {
+		e.buffer = append(e.buffer[:e.cursor], e.buffer[e.cursor+1:]...)
+	}
+}
+
+func (e *LineEditor) moveLeft() {
+	if e.cursor > 0 {
+		e.cursor--
+	}
+}
+
+func (e *LineEditor) moveRight() {
+	if e.cursor < len(e.buffer) {
+		e.cursor++
+	}
+}
+
+// moveUp moves to the previous line of the entry, or to the previous history
+// entry from the first line
+func (e *LineEditor) moveUp() {
+	start := e.lineStart()
+	if start == 0 {
+		e.browseHistory(-1)
+		return
+	}
+	column := e.cursor - start
+	previousStart := e.lineStartAt(start - 1)
+	e.cursor = min(previousStart+column, start-1)
+}
+
+// moveDown moves to the next line of the entry, or to the next history entry
+// from the last line
+func (e *LineEditor) moveDown() {
+	end := e.lineEnd()
+	if end == len(e.buffer) {
+		e.browseHistory(1)
+		return
+	}
+	column := e.cursor - e.lineStart()
+	nextStart := end + 1
+	e.cursor = min(nextStart+column, e.lineEndAt(nextStart))
+}
+
+// browseHistory replaces the entry with an older or newer history entry,
+// keeping what was being typed to come back to
+func (e *LineEditor) browseHistory(direction int) {
+	position := e.historyPos + direction
+	if position < 0 || position > len(e.history) {
+		return
+	}
+	if e.historyPos == len(e.history) {
+		e.draft = e.buffer
+	}
+	e.historyPos = position
+	if position == len(e.history) {
+		e.buffer = e.draft
+	} else {
+		e.buffer = []rune(e.history[position])
+	}
+	e.cursor = len(e.buffer)
+}
+
+func (e *LineEditor) lineStart() int { return e.lineStartAt(e.cursor) }
+func (e *LineEditor) lineEnd() int   { return e.lineEndAt(e.cursor) }
+
+func (e *LineEditor) lineStartAt(position int) int {
+	for position > 0 && e.buffer[position-1] != '\n' {
+		position--
+	}
+	return position
+}
+
+func (e *LineEditor) lineEndAt(position int) int {
+	for position < len(e.buffer) && e.buffer[position] != '\n' {
+		position++
+	}
+	return position
+}
+
+func (e *LineEditor) wordStart() int {
+	position := e.cursor
+	for position > 0 && unicode.IsSpace(e.buffer[position-1]) {
+		position--
+	}
+	for position > 0 && !unicode.IsSpace(e.buffer[position-1]) {
+		position--
+	}
+	return position
+}
+
+func (e *LineEditor) wordEnd() int {
+	position := e.cursor
+	for position < len(e.buffer) && unicode.IsSpace(e.buffer[position]) {
+		position++
+	}
+	for position < len(e.buffer) && !unicode.IsSpace(e.buffer[position]) {
+		position++
+	}
+	return position
+}
+
+func (e *LineEditor) render() { e.renderWithPrompt(e.prompt) }
+
+// renderWithPrompt redraws the entry in place. Continuation lines are
+// indented to line up with the first one. Every rune is assumed to take up
+// one column.
+func (e *LineEditor) renderWithPrompt(prompt string) {
+	width := 80
+	if columns, _, err := term.GetSize(int(e.in.Fd())); err == nil && columns > 0 {
+		width = columns
+	}
+	promptWidth := len([]rune(ansiEscape.ReplaceAllString(prompt, "")))
+	indent := strings.Repeat(" ", promptWidth)
+
+	var screen strings.Builder
+	if e.cursorRow > 0 {
+		fmt.Fprintf(&screen, "\x1b[%dA", e.cursorRow)
+	}
+	screen.WriteString("\r" + clearToEndOfScreen + prompt)
+
+	// Track the row and column of every position to place the cursor
+	row, column := 0, promptWidth
+	cursorRow, cursorColumn := 0, promptWidth
+	for i, r := range e.buffer {
+		if i == e.cursor {
+			cursorRow, cursorColumn = row, column
+		}
+		if r == '\n' {
+			screen.WriteString("\r\n" + indent)
+			row, column = row+1, promptWidth
+			continue
+		}
+		if r == '\t' {
+			r = ' '
+		}
+		screen.WriteRune(r)
+		column++
+		if column == width {
+			// Force the wrap so the terminal's cursor matches ours
+			screen.WriteString("\r\n")
+			row, column = row+1, 0
+		}
+	}
+	if e.cursor == len(e.buffer) {
+		cursorRow, cursorColumn = row, column
+	}
+
+	if row > cursorRow {
+		fmt.Fprintf(&screen, "\x1b[%dA", row-cursorRow)
+	}
+	screen.WriteString("\r")
+	if cursorColumn > 0 {
+		fmt.Fprintf(&screen, "\x1b[%dC", cursorColumn)
+	}
+	e.cursorRow = cursorRow
+	fmt.Fprint(e.out, screen.String())
+}
+
+// finish moves below the entry so that output continues after it
+func (e *LineEditor) finish() {
+	e.cursor = len(e.buffer)
+	e.render()
+	fmt.Fprint(e.out, "\r\n")
+	e.cursorRow = 0
+}
+
+// addHistory records a submitted entry, skipping blanks and repeats
+func (e *LineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if e.historyPath == "" {
+		return
+	}
+	if err := appendHistory(e.historyPath, line); err != nil {
+		fmt.Fprintf(e.out, "Warning: Failed to save history: %v\r\n", err)
+	}
+}
+
+// loadHistory reads the history file, which holds one quoted entry per line
+// so that multi-line entries survive. Once the file has grown well past the
+// limit it is rewritten with the most recent entries.
+func loadHistory(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	history := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if entry, err := strconv.Unquote(line); err == nil {
+			history = append(history, entry)
+		}
+	}
+	if len(history) <= maxHistoryEntries {
+		return history, nil
+	}
+
+	history = history[len(history)-maxHistoryEntries:]
+	var trimmed strings.Builder
+	for _, entry := range history {
+		trimmed.WriteString(strconv.Quote(entry) + "\n")
+	}
+	return history, os.WriteFile(path, []byte(trimmed.String()), 0600)
+}
+
+// appendHistory adds an entry to the history file
+func appendHistory(path, entry string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(strconv.Quote(entry) + "\n")
+	return err
+}
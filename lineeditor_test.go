@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadPlain(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"lines", "first\nsecond\n", []string{"first", "second"}},
+		{"carriage returns", "first\r\nsecond\r\n", []string{"first", "second"}},
+		{"last line without a newline", "first\nsecond", []string{"first", "second"}},
+		{"continued lines", "first \\\nstill first\nsecond\n", []string{"first \nstill first", "second"}},
+		{"continuation at the end of the input", "first \\\n", []string{"first "}},
+		{"blank lines", "\n\nlast\n", []string{"", "", "last"}},
+		{"long line", strings.Repeat("x", 100000) + "\n", []string{strings.Repeat("x", 100000)}},
+		{"empty input", "", []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			editor := &LineEditor{out: io.Discard, reader: bufio.NewReader(strings.NewReader(test.input))}
+			got := []string{}
+			for {
+				line, ok := editor.readPlain()
+				if !ok {
+					break
+				}
+				got = append(got, line)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("readPlain read %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent", "history")
+	editor := &LineEditor{out: io.Discard, historyPath: path}
+	for _, line := range []string{
+		"first",
+		"two\nlines",
+		`"quoted" and \backslashed\`,
+		"tab\tand unicode ✓",
+		"tab\tand unicode ✓",
+		"   ",
+		"first",
+	} {
+		editor.addHistory(line)
+	}
+
+	// Blank entries and immediate repeats aren't recorded
+	want := []string{"first", "two\nlines", `"quoted" and \backslashed\`, "tab\tand unicode ✓", "first"}
+	if !slices.Equal(editor.history, want) {
+		t.Errorf("history = %q, want %q", editor.history, want)
+	}
+	loaded, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded, want) {
+		t.Errorf("loaded history = %q, want %q", loaded, want)
+	}
+}
+
+func TestLoadHistoryTrimsOldEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	var file strings.Builder
+	for i := range maxHistoryEntries + 10 {
+		fmt.Fprintf(&file, "%q\n", fmt.Sprintf("entry %d", i))
+	}
+	// A damaged line is skipped rather than failing the whole history
+	file.WriteString("\"cut short\n")
+	if err := os.WriteFile(path, []byte(file.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		history, err := loadHistory(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != maxHistoryEntries || history[0] != "entry 10" || history[len(history)-1] != fmt.Sprintf("entry %d", maxHistoryEntries+9) {
+			t.Fatalf("loaded %d entries from %q to %q", len(history), history[0], history[len(history)-1])
+		}
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -19,8 +23,9 @@ import (
 	"github.com/invopop/jsonschema"
 )
 
-// LoadDynamicTools loads tool definitions from a configuration file
-func LoadDynamicTools(configPath string) ([]ToolDefinition, error) {
+// LoadDynamicTools loads tool definitions from a configuration file. Tools
+// that can't be created are skipped with a warning written to out.
+func LoadDynamicTools(out io.Writer, configPath string) ([]ToolDefinition, error) {
 	configFile, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read tools config file: %w", err)
@@ -35,7 +40,7 @@ func LoadDynamicTools(configPath string) ([]ToolDefinition, error) {
 	for _, dynTool := range config.Tools {
 		toolDef, err := createDynamicToolDefinition(dynTool)
 		if err != nil {
-			fmt.Printf("Warning: Failed to create tool %s: %v\n", dynTool.Name, err)
+			fmt.Fprintf(out, "Warning: Failed to create tool %s: %v\n", dynTool.Name, err)
 			continue
 		}
 		tools = append(tools, toolDef)
@@ -65,7 +70,7 @@ func createDynamicToolDefinition(config DynamicTool) (ToolDefinition, error) {
 	}
 
 	// Create the executor function that will handle this tool
-	executor := func(input json.RawMessage) (string, error) {
+	executor := func(ctx context.Context, input json.RawMessage) (string, error) {
 		// Parse the input as a map
 		var params map[string]interface{}
 		if err := json.Unmarshal(input, &params); err != nil {
@@ -112,7 +117,7 @@ func createDynamicToolDefinition(config DynamicTool) (ToolDefinition, error) {
 		}
 
 		// Execute the command (reusing our existing ExecuteCommand logic)
-		return ExecuteCommand(json.RawMessage(fmt.Sprintf(`{"command": %q, "timeout": %d}`, command, timeout)))
+		return ExecuteCommand(ctx, json.RawMessage(fmt.Sprintf(`{"command": %q, "timeout": %d}`, command, timeout)))
 	}
 
 	return ToolDefinition{
@@ -124,179 +129,568 @@ func createDynamicToolDefinition(config DynamicTool) (ToolDefinition, error) {
 }
 
 func main() {
+	resumeID := flag.String("resume", "", "Resume the saved session with the given ID")
+	continueLast := flag.Bool("continue", false, "Continue the most recently saved session")
+	var prompt string
+	flag.StringVar(&prompt, "p", "", "Run a single prompt without the interactive loop (\"-\" reads it from stdin)")
+	flag.StringVar(&prompt, "prompt", "", "Same as -p")
+	outputFormat := flag.String("output-format", outputText, "Output format with -p: text, json or stream-json")
+	maxTurns := flag.Int("max-turns", 0, "Maximum number of model responses with -p (0 for no limit)")
+	configFile := flag.String("config", defaultConfigPath, "Path to the config file")
+	model := flag.String("model", "", "Model to use")
+	maxTokens := flag.Int64("max-tokens", 0, "Maximum number of tokens per response")
+	temperature := flag.Float64("temperature", 0, "Sampling temperature between 0 and 1")
+	stopSequences := flag.String("stop", "", "Comma separated list of stop sequences")
+	budget := flag.Float64("budget", 0, "Session budget in USD; asks before going over it")
+	think := flag.Bool("think", false, "Enable extended thinking")
+	thinkingBudget := flag.Int64("thinking-budget", 0, "Maximum number of tokens spent thinking per response")
+	providerName := flag.String("provider", "", "Model API to use: anthropic or openai (OpenAI-compatible servers)")
+	baseURL := flag.String("base-url", "", "Base URL of the model API, e.g. http://localhost:11434/v1 for Ollama")
+	recordPath := flag.String("record", "", "Record the model API exchanges into the given cassette file")
+	replayPath := flag.String("replay", "", "Replay the model API exchanges from the given cassette file instead of calling the API")
+	planMode := flag.Bool("plan", false, "Start in plan mode: only read-only tools until a plan is approved")
+	flag.Parse()
+
+	headless := false
+	flag.Visit(func(f *flag.Flag) {
+		headless = headless || f.Name == "p" || f.Name == "prompt"
+	})
+	// Messages for the user go to status. A headless run keeps stdout for
+	// the result alone and prints everything else to stderr.
+	var status io.Writer = os.Stdout
+	if headless {
+		status = os.Stderr
+		switch *outputFormat {
+		case outputText, outputJSON, outputStreamJSON:
+		default:
+			fmt.Fprintf(os.Stderr, "Error: unknown output format %q\n", *outputFormat)
+			os.Exit(exitUsage)
+		}
+		if prompt == "" || prompt == "-" {
+			input, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to read prompt from stdin: %s\n", err.Error())
+				os.Exit(exitUsage)
+			}
+			prompt = string(input)
+		}
+		if strings.TrimSpace(prompt) == "" {
+			fmt.Fprintln(os.Stderr, "Error: the prompt is empty")
+			os.Exit(exitUsage)
+		}
+	}
+
+	// Flags take precedence over the config file and environment
+	config, err := LoadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(status, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "model":
+			config.Model = *model
+		case "max-tokens":
+			config.MaxTokens = *maxTokens
+		case "temperature":
+			config.Temperature = temperature
+		case "stop":
+			config.StopSequences = splitList(*stopSequences)
+		case "budget":
+			config.BudgetUSD = *budget
+		case "think":
+			config.Thinking = think
+		case "thinking-budget":
+			config.ThinkingBudget = *thinkingBudget
+		case "provider":
+			config.Provider = *providerName
+		case "base-url":
+			config.BaseURL = *baseURL
+		}
+	})
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(status, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	// Check if debug mode is requested
 	debug := os.Getenv("DEBUG") == "1"
 	if debug {
-		fmt.Println("Debug mode enabled. Tool responses will be printed to the terminal.")
+		fmt.Fprintln(status, "Debug mode enabled. Tool responses will be printed to the terminal.")
 	}
 
-	// Anthropic Client
-	client := anthropic.NewClient()
-
-	// Standard in input
-	scanner := bufio.NewScanner(os.Stdin)
-	// function literal (lambda)??
-	// returns the text and a bool representing whether we got the
-	// input or not
-	getUserMessage := func() (string, bool) {
-		if !scanner.Scan() {
-			return "", false
-		}
-		return scanner.Text(), true
+	// The model API, Anthropic unless configured otherwise
+	var httpClient *http.Client
+	transport, err := cassetteTransport(status, *recordPath, *replayPath)
+	if err != nil {
+		fmt.Fprintf(status, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if transport != nil {
+		httpClient = &http.Client{Transport: transport}
 	}
+	provider, err := NewProvider(config, httpClient)
+	if err != nil {
+		fmt.Fprintf(status, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// Read input with a line editor that keeps its history across runs
+	editor := NewLineEditor(status, defaultHistoryPath())
+	editor.HistoryPrompt = userPrompt
+	getUserMessage := editor.ReadLine
 
 	// Start with the built-in tools
-	tools := []ToolDefinition{ReadFileDefinition, ListFilesDefinition, EditFileDefinition, GrepDefinition, ExecuteCommandDefinition}
+	tools := []ToolDefinition{ReadFileDefinition, ListFilesDefinition, EditFileDefinition, MultiEditDefinition, ApplyPatchDefinition, GrepDefinition, ExecuteCommandDefinition}
 	
 	// Try to load dynamic tools from config
 	configPath := "tools_config.json"
-	if dynamicTools, err := LoadDynamicTools(configPath); err != nil {
-		fmt.Printf("Warning: Failed to load dynamic tools: %v\n", err)
+	if dynamicTools, err := LoadDynamicTools(status, configPath); err != nil {
+		fmt.Fprintf(status, "Warning: Failed to load dynamic tools: %v\n", err)
 	} else {
-		fmt.Printf("Loaded %d dynamic tools from %s\n", len(dynamicTools), configPath)
+		fmt.Fprintf(status, "Loaded %d dynamic tools from %s\n", len(dynamicTools), configPath)
 		tools = append(tools, dynamicTools...)
 	}
 
-	agent := NewAgent(&client, getUserMessage, tools)
-	err := agent.Run(context.TODO())
+	// Build the system prompt from the project's instruction files
+	workingDir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(status, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	systemPrompt := BuildSystemPrompt(status, workingDir)
+	for _, file := range systemPrompt.Files {
+		fmt.Fprintf(status, "Loaded instructions from %s\n", file)
+	}
+
+	agent := NewAgent(provider, getUserMessage, tools, config, systemPrompt.Text)
+	agent.out = status
+	agent.EnableTasks()
+	agent.SetPlanMode(*planMode)
+	userCommands := LoadUserCommands(status, workingDir)
+	agent.AddCommands(userCommands)
+	if len(userCommands) > 0 {
+		fmt.Fprintf(status, "Loaded %d user commands\n", len(userCommands))
+	}
+
+	// Pick up a previous session or start recording a new one
+	if *continueLast && *resumeID == "" {
+		id, err := LatestSessionID(sessionDir)
+		if err != nil {
+			fmt.Fprintf(status, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		*resumeID = id
+	}
+	var session *Session
+	if *resumeID != "" {
+		resumed, conversation, err := ResumeSession(status, sessionDir, *resumeID)
+		if err != nil {
+			fmt.Fprintf(status, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		session = resumed
+		agent.UseSession(session, conversation)
+		fmt.Fprintf(status, "Resumed session %s (%d messages)\n", session.ID, len(conversation))
+	} else if newSession, err := NewSession(sessionDir); err != nil {
+		fmt.Fprintf(status, "Warning: Failed to create session file: %v\n", err)
+	} else {
+		session = newSession
+		agent.UseSession(session, nil)
+	}
+
+	// Exit cleanly on a double Ctrl-C, leaving the session resumable
+	exit := func() {
+		if session != nil {
+			session.Close()
+			fmt.Fprintf(status, "Session saved. Resume it with --resume %s\n", session.ID)
+		}
+	}
+	interrupter := handleInterrupts(agent, func() {
+		exit()
+		os.Exit(exitInterrupted)
+	})
+	editor.OnInterrupt = interrupter.Interrupt
+
+	if headless {
+		result := agent.RunHeadless(context.Background(), prompt, *outputFormat, *maxTurns, os.Stdout)
+		exit()
+		os.Exit(result.ExitCode())
+	}
+
+	err = agent.Run(context.Background())
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
+		fmt.Fprintf(status, "Error: %s\n", err.Error())
 	}
+	exit()
 }
 
 // initialises the agent struct with an anthropic client and a function to get a user message.
 func NewAgent(
-	client *anthropic.Client,
-	getUserMessage func() (string, bool),
+	provider Provider,
+	getUserMessage func(prompt string) (string, bool),
 	tools []ToolDefinition,
+	config Config,
+	systemPrompt string,
 ) *Agent {
 	// Check if DEBUG environment variable is set
 	debugMode := os.Getenv("DEBUG") == "1"
 
-	return &Agent{
-		client:         client,
+	agent := &Agent{
+		provider:       provider,
 		getUserMessage: getUserMessage,
 		tools:          tools,
+		config:         config,
+		systemPrompt:   systemPrompt,
 		debugMode:      debugMode,
+		out:            os.Stdout,
+		compaction:     NewCompactionConfigFromEnv(),
+		usage:          NewUsageTracker(config.Pricing, config.BudgetUSD),
+		commands:       builtinCommands(),
+	}
+	// Responses are shown wherever the rest of the agent's output goes
+	agent.streamHandler = func(event anthropic.MessageStreamEventUnion, message *anthropic.Message) {
+		printStreamEvent(agent.out, event, message)
 	}
+	return agent
 }
 
 type Agent struct {
-	client         *anthropic.Client
-	getUserMessage func() (string, bool)
+	provider       Provider
+	getUserMessage func(prompt string) (string, bool)
 	tools          []ToolDefinition
+	config         Config
+	systemPrompt   string
 	debugMode      bool
+	compaction     CompactionConfig
+	conversation   []anthropic.MessageParam
+	session        *Session
+	streamHandler  StreamHandler
+	out            io.Writer // messages for the user besides streamed responses
+	onEvent        func(HeadlessEvent)
+	usage          *UsageTracker
+	commands       []Command
+
+	// mu guards cancelStep, which is called from the signal handler, and
+	// the plan mode state, which the submit_plan tool changes
+	mu         sync.Mutex
+	cancelStep context.CancelFunc
+	planMode   bool
+	// approvedPlan is kept in the system prompt once the user approves it
+	approvedPlan string
 }
 
+// Prompt for the messages the user sends to the agent
+const userPrompt = "\u001b[94mYou\u001b[0m: "
+
 func (a *Agent) Run(ctx context.Context) error {
-	// the running conversation
-	conversation := []anthropic.MessageParam{}
-	fmt.Println("Chat with Claude (use 'ctrl-c' to quit)")
+	fmt.Fprintln(a.out, "Chat with Claude (ctrl-c interrupts, press it twice to quit)")
 
 	readUserInput := true
 	for {
 		if readUserInput {
-			fmt.Print("\u001b[94mYou\u001b[0m: ")
 			// Get a message from the user
-			userInput, ok := a.getUserMessage()
+			userInput, ok := a.getUserMessage(userPrompt)
 			if !ok {
 				break
 			}
 
+			// Slash commands control the agent rather than going to the model
+			prompt, isCommand, err := a.handleCommand(ctx, userInput)
+			if errors.Is(err, errQuit) {
+				break
+			}
+			if err != nil {
+				fmt.Fprintf(a.out, "\u001b[91merror\u001b[0m: %s\n", err.Error())
+				continue
+			}
+			if isCommand {
+				if prompt == "" {
+					continue
+				}
+				userInput = prompt
+			}
+
 			// Add the user message to the conversation history
-			userMessage := anthropic.NewUserMessage(anthropic.NewTextBlock(userInput))
-			conversation = append(conversation, userMessage)
+			userMessage := newUserMessage(a.out, userInput)
+			a.appendMessage(userMessage)
 		}
 
-		// Send the message to Anthropic for inference
-		message, err := a.runInference(ctx, conversation)
-		if err != nil {
-			return err
+		// Everything up to the next prompt can be interrupted with Ctrl-C
+		stepCtx, endStep := a.beginStep(ctx)
+		needsReply, err := a.step(stepCtx)
+		interrupted := stepCtx.Err() != nil
+		endStep()
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		// Add the assistant message to the conversation history
-		conversation = append(conversation, message.ToParam())
-
-		toolResults := []anthropic.ContentBlockParamUnion{}
-		// Display the AI response
-		for _, content := range message.Content {
-			switch content.Type {
-			case "text":
-				fmt.Printf("\u001b[93mClaude\u001b[0m: %s\n", content.Text)
-			case "tool_use":
-				result := a.executeTool(content.ID, content.Name, content.Input)
-				toolResults = append(toolResults, result)
-			}
+		// If inference fails even after retrying, hand back to the user
+		// rather than ending the session
+		if err != nil && !interrupted {
+			fmt.Fprintf(a.out, "\u001b[91merror\u001b[0m: %s\n", err.Error())
+			fmt.Fprintln(a.out, "Your message is kept; send another message to try again.")
 		}
-		// If we have tool call results, we should reply with them
-		// Otherwise, we don't have anything to reply with until we ask the user
-		if len(toolResults) == 0 {
-			readUserInput = true
-			continue
+		// If we performed a tool call, we reply with the results. Otherwise
+		// we don't have anything to reply with until we ask the user
+		readUserInput = err != nil || interrupted || !needsReply
+		if readUserInput {
+			if summary := a.usage.EndTurn(); summary != "" {
+				fmt.Fprintf(a.out, "\u001b[90m%s\u001b[0m\n", summary)
+			}
 		}
-		// if we're here, we performed a tool call and got a result
-		readUserInput = false
-		conversation = append(conversation, anthropic.NewUserMessage(toolResults...))
 	}
 
 	return nil
 }
 
-func (a *Agent) executeTool(id, name string, input json.RawMessage) anthropic.ContentBlockParamUnion {
-	var toolDef ToolDefinition
-	var found bool
-	// Find the tool from our agent's collection of tools
-	for _, tool := range a.tools {
-		if tool.Name == name {
-			toolDef = tool
-			found = true
-			break
+// step runs one round of inference and executes the tools the model asked
+// for. It reports whether the tool results need to be sent back to the model,
+// i.e. whether the model still has work to do.
+func (a *Agent) step(ctx context.Context) (bool, error) {
+	// Keep the conversation within the context window
+	if err := a.maybeCompact(ctx); err != nil && ctx.Err() == nil {
+		fmt.Fprintf(a.out, "Warning: %s\n", err.Error())
+	}
+
+	// Don't run past the session budget without asking
+	if err := a.checkBudget(); err != nil {
+		return false, err
+	}
+
+	// Send the message to Anthropic for inference
+	message, truncatedTool, err := a.completeResponse(ctx)
+	if err != nil {
+		return false, err
+	}
+	// Add the assistant message to the conversation history
+	a.appendMessage(message)
+
+	// The response text has already been streamed, so all that is left is
+	// to run the requested tools
+	toolUses := []*anthropic.ToolUseBlockParam{}
+	for _, content := range message.Content {
+		if content.OfRequestToolUseBlock != nil {
+			toolUses = append(toolUses, content.OfRequestToolUseBlock)
+		}
+	}
+	toolResults := a.executeTools(ctx, toolUses)
+	if ctx.Err() != nil {
+		// Record the interrupted calls but don't carry on
+		if len(toolResults) > 0 {
+			a.appendMessage(anthropic.NewUserMessage(toolResults...))
 		}
+		return false, nil
+	}
+
+	// Ask the model to redo a tool call that was cut off by max_tokens
+	if truncatedTool != "" {
+		toolResults = append(toolResults, anthropic.NewTextBlock(fmt.Sprintf(
+			"Your previous response hit the max_tokens limit while writing the input for the %s tool, so that call was discarded. Please make the call again, splitting it into smaller calls if the input is large.",
+			truncatedTool,
+		)))
 	}
+	if len(toolResults) == 0 {
+		return false, nil
+	}
+	a.appendMessage(anthropic.NewUserMessage(toolResults...))
+	return true, nil
+}
 
+// appendMessage adds a message to the conversation and records it in the
+// session file, if there is one.
+func (a *Agent) appendMessage(message anthropic.MessageParam) {
+	a.conversation = append(a.conversation, message)
+	a.emit(HeadlessEvent{Type: "message", Message: &message})
+	if a.session == nil {
+		return
+	}
+	if err := a.session.Append(message); err != nil {
+		fmt.Fprintf(a.out, "Warning: Failed to save message to session: %v\n", err)
+	}
+}
+
+// setConversation replaces the whole conversation, e.g. after compaction
+func (a *Agent) setConversation(conversation []anthropic.MessageParam) {
+	a.conversation = conversation
+	if a.session == nil {
+		return
+	}
+	if err := a.session.Reset(conversation); err != nil {
+		fmt.Fprintf(a.out, "Warning: Failed to save conversation to session: %v\n", err)
+	}
+}
+
+// UseSession records new messages to the given session, continuing from a
+// previously saved conversation if there is one.
+func (a *Agent) UseSession(session *Session, conversation []anthropic.MessageParam) {
+	a.session = session
+	a.conversation = conversation
+}
+
+func (a *Agent) executeTool(ctx context.Context, id, name string, input json.RawMessage) anthropic.ContentBlockParamUnion {
+	// Find the tool from our agent's collection of tools
+	toolDef, found := a.findTool(name)
 	if !found {
+		a.emit(HeadlessEvent{Type: "tool_call", ToolUseID: id, Name: name, Input: input, IsError: true})
 		return anthropic.NewToolResultBlock(id, "tool not found", true)
 	}
 
-	fmt.Printf("\u001b[92mtool\u001b[0m: %s(%s)\n", name, input)
 	// execute the tool
-	response, err := toolDef.Function(input)
+	start := time.Now()
+	result, err := toolDef.run(ctx, input)
+	a.emit(HeadlessEvent{
+		Type:       "tool_call",
+		ToolUseID:  id,
+		Name:       name,
+		Input:      input,
+		IsError:    err != nil,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
 	
 	// If debug mode is enabled, print the tool response or error
 	if a.debugMode {
 		if err != nil {
-			fmt.Printf("\u001b[96mdebug\u001b[0m: Tool error: %s\n", err.Error())
+			fmt.Fprintf(a.out, "\u001b[96mdebug\u001b[0m: Tool error: %s\n", err.Error())
 		} else {
-			fmt.Printf("\u001b[96mdebug\u001b[0m: Tool response: %s\n", response)
+			fmt.Fprintf(a.out, "\u001b[96mdebug\u001b[0m: Tool response: %s\n", result.Text)
+			if len(result.Images) > 0 {
+				fmt.Fprintf(a.out, "\u001b[96mdebug\u001b[0m: Tool response has %d images\n", len(result.Images))
+			}
 		}
 	}
 	
+	if ctx.Err() != nil {
+		return anthropic.NewToolResultBlock(id, interruptedToolResult, true)
+	}
+	if err != nil {
+		result = ToolResult{Text: err.Error()}
+	}
+	// The result is sent back to the model, so it counts towards input tokens
+	a.usage.RecordToolCall(name, result.EstimatedTokens())
 	if err != nil {
 		return anthropic.NewToolResultBlock(id, err.Error(), true)
 	}
 	
-	return anthropic.NewToolResultBlock(id, response, false)
-}
-
-func (a *Agent) runInference(ctx context.Context, conversation []anthropic.MessageParam) (*anthropic.Message, error) {
-	anthropicTools := []anthropic.ToolUnionParam{}
-	// go through each tool defined in our agent, and convert it to the type accepted here.
-	for _, tool := range a.tools {
-		anthropicTools = append(anthropicTools, anthropic.ToolUnionParam{
-			OfTool: &anthropic.ToolParam{
-				Name:        tool.Name,
-				Description: anthropic.String(tool.Description),
-				InputSchema: tool.InputSchema,
-			},
-		})
-	}
-
-	message, err := a.client.Messages.New(ctx, anthropic.MessageNewParams{
-		Model:     anthropic.ModelClaude3_7SonnetLatest,
-		MaxTokens: int64(1024),
-		Messages:  conversation,
-		Tools:     anthropicTools,
+	return result.block(id)
+}
+
+// runInference streams a response to the conversation, showing it with
+// handler, and retries failed requests
+func (a *Agent) runInference(ctx context.Context, conversation []anthropic.MessageParam, handler StreamHandler) (*anthropic.Message, error) {
+	request := InferenceRequest{
+		Model:         a.config.Model,
+		MaxTokens:     a.config.MaxTokens,
+		System:        a.requestSystemPrompt(),
+		Messages:      conversation,
+		Tools:         a.activeTools(),
+		StopSequences: a.config.StopSequences,
+		Temperature:   a.config.Temperature,
+	}
+	if a.config.thinkingEnabled() {
+		request.ThinkingBudget = a.config.ThinkingBudget
+	}
+
+	// Stream the response so text shows up as it is generated
+	streamed := false
+	if show := handler; show != nil {
+		handler = func(event anthropic.MessageStreamEventUnion, message *anthropic.Message) {
+			streamed = true
+			show(event, message)
+		}
+	}
+	message, err := withRetry(ctx, a.out, a.config.maxRetries(), func() (*anthropic.Message, error) {
+		streamed = false
+		message, err := accumulateStream(a.provider.Stream(ctx, request), handler)
+		if err != nil && streamed {
+			// A retry streams the whole response again, so mark where the
+			// partial one ends
+			fmt.Fprintln(a.out, "\n\u001b[96minfo\u001b[0m: Response interrupted, the text above is incomplete")
+		}
+		return message, err
 	})
-	return message, err
+	if err != nil {
+		return nil, err
+	}
+	a.usage.RecordInference(a.config.Model, "chat", message.Usage)
+	if a.debugMode {
+		printCacheUsage(a.out, message.Usage)
+	}
+	return message, nil
+}
+
+// Maximum number of times a response cut off by max_tokens is continued
+const maxContinuations = 3
+
+// completeResponse runs inference on the conversation and recovers from
+// responses cut off by max_tokens. Truncated text is continued by sending the
+// partial answer back as a prefill. A truncated tool_use is dropped, since its
+// input is incomplete JSON, and its name is returned so the model can be asked
+// to redo it.
+func (a *Agent) completeResponse(ctx context.Context) (anthropic.MessageParam, string, error) {
+	message, err := a.runInference(ctx, a.conversation, a.streamHandler)
+	if err != nil {
+		return anthropic.MessageParam{}, "", err
+	}
+	response := message.ToParam()
+
+	for continuations := 0; message.StopReason == anthropic.MessageStopReasonMaxTokens; continuations++ {
+		if len(response.Content) == 0 {
+			break
+		}
+		last := response.Content[len(response.Content)-1]
+
+		// A thinking block cut off before its signature can't be sent back
+		if last.OfRequestThinkingBlock != nil && last.OfRequestThinkingBlock.Signature == "" {
+			response.Content = response.Content[:len(response.Content)-1]
+			if len(response.Content) == 0 {
+				response.Content = append(response.Content, anthropic.NewTextBlock("[Response cut off by max_tokens while thinking]"))
+			}
+			fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Response hit max_tokens while thinking; raise the max tokens or lower the thinking budget")
+			break
+		}
+
+		if toolUse := last.OfRequestToolUseBlock; toolUse != nil {
+			response.Content = response.Content[:len(response.Content)-1]
+			if len(response.Content) == 0 {
+				// An assistant message can't be empty
+				response.Content = append(response.Content, anthropic.NewTextBlock(
+					fmt.Sprintf("[Call to %s cut off by max_tokens]", toolUse.Name),
+				))
+			}
+			fmt.Fprintf(a.out, "\u001b[96minfo\u001b[0m: Response hit max_tokens while calling %s, asking Claude to retry\n", toolUse.Name)
+			return response, toolUse.Name, nil
+		}
+
+		if last.OfRequestTextBlock == nil || continuations == maxContinuations {
+			break
+		}
+		// The API doesn't accept a prefilled response with thinking enabled
+		if a.config.thinkingEnabled() {
+			fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Response hit max_tokens and can't be continued with thinking enabled")
+			break
+		}
+
+		// The API rejects a prefill that ends in whitespace
+		last.OfRequestTextBlock.Text = strings.TrimRight(last.OfRequestTextBlock.Text, " \t\r\n")
+		if last.OfRequestTextBlock.Text == "" {
+			break
+		}
+		fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Response hit max_tokens, continuing")
+		message, err = a.runInference(ctx, append(a.conversation, response), continuationHandler(a.streamHandler))
+		if err != nil {
+			return anthropic.MessageParam{}, "", err
+		}
+
+		// Stitch the continuation onto the partial text block
+		continuation := message.ToParam().Content
+		if len(continuation) > 0 && continuation[0].OfRequestTextBlock != nil {
+			last.OfRequestTextBlock.Text += continuation[0].OfRequestTextBlock.Text
+			continuation = continuation[1:]
+		}
+		response.Content = append(response.Content, continuation...)
+	}
+
+	return response, "", nil
 }
 
 // PathFilter defines a reusable interface for filtering files and directories
@@ -388,15 +782,60 @@ type ToolDefinition struct {
 	Name        string                         `json:"name"`
 	Description string                         `json:"description"`
 	InputSchema anthropic.ToolInputSchemaParam `json:"input_schema"`
-	Function    func(input json.RawMessage) (string, error)
+	Function    func(ctx context.Context, input json.RawMessage) (string, error)
+	// ResultFunction is used instead of Function by tools whose results can
+	// hold more than text, such as images
+	ResultFunction func(ctx context.Context, input json.RawMessage) (ToolResult, error) `json:"-"`
+	// Concurrency says whether calls to this tool may overlap with others
+	Concurrency ToolConcurrency `json:"-"`
+}
+
+// run calls the tool's function
+func (t ToolDefinition) run(ctx context.Context, input json.RawMessage) (ToolResult, error) {
+	if t.ResultFunction != nil {
+		return t.ResultFunction(ctx, input)
+	}
+	text, err := t.Function(ctx, input)
+	return ToolResult{Text: text}, err
+}
+
+// ToolResult is what a tool sends back to the model: text, along with
+// images for tools that can return them
+type ToolResult struct {
+	Text   string
+	Images []Image
+}
+
+// EstimatedTokens approximates how many input tokens the result will use
+func (r ToolResult) EstimatedTokens() int {
+	tokens := len(r.Text) / 4
+	for _, image := range r.Images {
+		tokens += image.EstimatedTokens()
+	}
+	return tokens
+}
+
+// block converts the result into a tool_result block
+func (r ToolResult) block(id string) anthropic.ContentBlockParamUnion {
+	block := anthropic.NewToolResultBlock(id, r.Text, false)
+	result := block.OfRequestToolResultBlock
+	if r.Text == "" && len(r.Images) > 0 {
+		// The API rejects empty text blocks
+		result.Content = nil
+	}
+	for _, image := range r.Images {
+		result.Content = append(result.Content, anthropic.ToolResultBlockParamContentUnion{OfRequestImageBlock: image.blockParam()})
+	}
+	return block
 }
 
 // The read file tool
 var ReadFileDefinition = ToolDefinition{
-	Name:        "read_file",
-	Description: "Read the contents of a given relative file path. Use this when you want to see what's inside a file. Do not use this with directory names.",
-	InputSchema: ReadFileInputSchema,
-	Function:    ReadFile,
+	Name:           "read_file",
+	Description:    "Read the contents of a given relative file path. Use this when you want to see what's inside a file. Images (png, jpeg, gif and webp) are returned as images you can see, other binary files as a summary. Text in other encodings, such as UTF-16 or Latin-1, is converted to UTF-8. Do not use this with directory names. Returns at most 2000 lines or 100KB by default; use offset and limit to read large files in parts, and line_numbers to see line numbers.",
+	InputSchema:    ReadFileInputSchema,
+	ResultFunction: ReadFile,
+	Concurrency:    ConcurrencyReadsPath,
 }
 
 // The list files tool
@@ -405,18 +844,7 @@ var ListFilesDefinition = ToolDefinition{
 	Description: "List files and directories at a given path. If no path is provided, lists files in the current directory. By default excludes .git directory, hidden files, and common directories like node_modules. Use include_git, include_hidden, and exclude parameters to customize filtering.",
 	InputSchema: ListFilesInputSchema,
 	Function:    ListFiles,
-}
-
-var EditFileDefinition = ToolDefinition{
-	Name: "edit_file",
-	Description: `Make edits to a text file.
-
-Replaces 'old_str' with 'new_str' in the given file. 'old_str' and 'new_str' MUST be different from each other.
-
-If the file specified with path doesn't exist, it will be created.
-`,
-	InputSchema: EditFileInputSchema,
-	Function:    EditFile,
+	Concurrency: ConcurrencyReadOnly,
 }
 
 // The grep tool
@@ -425,6 +853,7 @@ var GrepDefinition = ToolDefinition{
 	Description: "Search for a regular expression pattern in files. Returns matching lines with file names and line numbers. By default excludes .git directory, hidden files, and common directories like node_modules. Use include_git, include_hidden, and exclude parameters to customize filtering.",
 	InputSchema: GrepInputSchema,
 	Function:    Grep,
+	Concurrency: ConcurrencyReadOnly,
 }
 
 // The execute command tool
@@ -433,11 +862,15 @@ var ExecuteCommandDefinition = ToolDefinition{
 	Description: "Execute a shell command and return its output. The command is executed in a bash shell on Unix-like systems and cmd on Windows. Has a configurable timeout (default 30 seconds, max 5 minutes). Returns stdout, stderr, and exit code.",
 	InputSchema: ExecuteCommandInputSchema,
 	Function:    ExecuteCommand,
+	Concurrency: ConcurrencyExclusive,
 }
 
 type ReadFileInput struct {
 	// the file path input, annotated with a json name and description
-	Path string `json:"path" jsonschema_description:"The relative path of a file in the working directory."`
+	Path        string `json:"path" jsonschema_description:"The relative path of a file in the working directory."`
+	Offset      int    `json:"offset,omitempty" jsonschema_description:"Optional 1-based line number to start reading from. Defaults to 1."`
+	Limit       int    `json:"limit,omitempty" jsonschema_description:"Optional maximum number of lines to read. Defaults to 2000."`
+	LineNumbers bool   `json:"line_numbers,omitempty" jsonschema_description:"Set to true to prefix every line with its line number. Defaults to false."`
 }
 type ListFilesInput struct {
 	Path          string   `json:"path,omitempty" jsonschema_description:"Optional relative path to list files from. Defaults to current directory if not provided."`
@@ -445,11 +878,6 @@ type ListFilesInput struct {
 	IncludeHidden bool     `json:"include_hidden,omitempty" jsonschema_description:"Set to true to include hidden files and directories (starting with .). Defaults to false."`
 	Exclude       []string `json:"exclude,omitempty" jsonschema_description:"Optional list of directories or files to exclude from results."`
 }
-type EditFileInput struct {
-	Path   string `json:"path" jsonschema_description:"The path to the file"`
-	OldStr string `json:"old_str" jsonschema_description:"Text to search for - must match exactly and must only have one match exactly"`
-	NewStr string `json:"new_str" jsonschema_description:"Text to replace old_str with"`
-}
 type GrepInput struct {
 	Pattern       string   `json:"pattern" jsonschema_description:"The regular expression pattern to search for in files"`
 	Path          string   `json:"path,omitempty" jsonschema_description:"Optional relative path to search in. Defaults to current directory if not provided"`
@@ -485,7 +913,6 @@ type ToolParameter struct {
 
 var ReadFileInputSchema = GenerateSchema[ReadFileInput]()
 var ListFilesInputSchema = GenerateSchema[ListFilesInput]()
-var EditFileInputSchema = GenerateSchema[EditFileInput]()
 var GrepInputSchema = GenerateSchema[GrepInput]()
 var ExecuteCommandInputSchema = GenerateSchema[ExecuteCommandInput]()
 
@@ -504,28 +931,87 @@ func GenerateSchema[T any]() anthropic.ToolInputSchemaParam {
 	}
 }
 
-func ReadFile(input json.RawMessage) (string, error) {
+func ReadFile(ctx context.Context, input json.RawMessage) (ToolResult, error) {
 	readFileInput := ReadFileInput{}
 	// Parse the JSON supplied by the LLM (conforms to our json schema definition of the tool)
 	err := json.Unmarshal(input, &readFileInput)
 	if err != nil {
-		panic(err)
+		return ToolResult{}, err
+	}
+
+	if readFileInput.Offset < 0 || readFileInput.Limit < 0 {
+		return ToolResult{}, fmt.Errorf("offset and limit cannot be negative")
+	}
+	offset := max(readFileInput.Offset, 1)
+	limit := readFileInput.Limit
+	if limit == 0 {
+		limit = defaultReadLimit
 	}
 
-	// Read a file from the OS based on the path
-	content, err := os.ReadFile(readFileInput.Path)
+	// Open the file from the OS based on the path
+	file, err := os.Open(readFileInput.Path)
 	if err != nil {
-		return "", err
+		return ToolResult{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return ToolResult{}, err
+	}
+	if info.IsDir() {
+		return ToolResult{}, fmt.Errorf("%s is a directory, not a file; use list_files to see what it contains", readFileInput.Path)
+	}
+
+	// Images are sent as images rather than as their bytes
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return ToolResult{}, err
 	}
-	// return the contents of the file
-	return string(content), nil
+	head = head[:n]
+	if mediaType, ok := imageMediaType(head); ok {
+		rest, err := io.ReadAll(file)
+		if err != nil {
+			return ToolResult{}, err
+		}
+		image, err := loadImage(append(head, rest...), mediaType)
+		if err != nil {
+			return ToolResult{}, err
+		}
+		return ToolResult{Text: "Image " + image.Describe(readFileInput.Path), Images: []Image{image}}, nil
+	}
+
+	// Binary files are summarized and other text encodings converted to UTF-8
+	encoding, isText := detectEncoding(head)
+	if !isText {
+		return ToolResult{Text: describeBinary(readFileInput.Path, info.Size(), head)}, nil
+	}
+
+	// Only return the requested lines, within the size cap
+	excerpt, err := readLines(encoding.reader(io.MultiReader(bytes.NewReader(head), file)), offset, limit, maxReadBytes, readFileInput.LineNumbers)
+	if err != nil {
+		return ToolResult{}, err
+	}
+	if offset > 1 && offset > excerpt.TotalLines {
+		return ToolResult{}, fmt.Errorf("offset %d is past the end of the file, which has %d lines", offset, excerpt.TotalLines)
+	}
+	notices := []string{}
+	for _, notice := range []string{excerpt.notice(), encoding.notice()} {
+		if notice != "" {
+			notices = append(notices, notice)
+		}
+	}
+	if len(notices) > 0 {
+		return ToolResult{Text: strings.TrimSuffix(excerpt.Text, "\n") + "\n\n" + strings.Join(notices, "\n")}, nil
+	}
+	return ToolResult{Text: excerpt.Text}, nil
 }
 
-func ListFiles(input json.RawMessage) (string, error) {
+func ListFiles(ctx context.Context, input json.RawMessage) (string, error) {
 	listFilesInput := ListFilesInput{}
 	err := json.Unmarshal(input, &listFilesInput)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	dir := "."
@@ -534,17 +1020,20 @@ func ListFiles(input json.RawMessage) (string, error) {
 	}
 
 	// Create path filter based on user options
-	filter := &DefaultPathFilter{
-		IncludeGit:    listFilesInput.IncludeGit,
-		IncludeHidden: listFilesInput.IncludeHidden,
-		CustomExcludes: listFilesInput.Exclude,
-	}
+	filter := NewDefaultPathFilter()
+	filter.IncludeGit = listFilesInput.IncludeGit
+	filter.IncludeHidden = listFilesInput.IncludeHidden
+	filter.CustomExcludes = append(filter.CustomExcludes, listFilesInput.Exclude...)
 
 	var files []string
 	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		// Stop walking if the tool call was interrupted
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
 		relPath, err := filepath.Rel(dir, path)
 		if err != nil {
@@ -584,58 +1073,7 @@ func ListFiles(input json.RawMessage) (string, error) {
 	return string(result), nil
 }
 
-func EditFile(input json.RawMessage) (string, error) {
-	editFileInput := EditFileInput{}
-	err := json.Unmarshal(input, &editFileInput)
-	if err != nil {
-		return "", err
-	}
-
-	if editFileInput.Path == "" || editFileInput.OldStr == editFileInput.NewStr {
-		return "", fmt.Errorf("invalid input parameters")
-	}
-
-	content, err := os.ReadFile(editFileInput.Path)
-	if err != nil {
-		if os.IsNotExist(err) && editFileInput.OldStr == "" {
-			return createNewFile(editFileInput.Path, editFileInput.NewStr)
-		}
-		return "", err
-	}
-
-	oldContent := string(content)
-	newContent := strings.Replace(oldContent, editFileInput.OldStr, editFileInput.NewStr, -1)
-
-	if oldContent == newContent && editFileInput.OldStr != "" {
-		return "", fmt.Errorf("old_str not found in file")
-	}
-
-	err = os.WriteFile(editFileInput.Path, []byte(newContent), 0644)
-	if err != nil {
-		return "", err
-	}
-
-	return "OK", nil
-}
-
-func createNewFile(filePath, content string) (string, error) {
-	dir := path.Dir(filePath)
-	if dir != "." {
-		err := os.MkdirAll(dir, 0755)
-		if err != nil {
-			return "", fmt.Errorf("failed to create directory: %w", err)
-		}
-	}
-
-	err := os.WriteFile(filePath, []byte(content), 0644)
-	if err != nil {
-		return "", fmt.Errorf("failed to create file: %w", err)
-	}
-
-	return fmt.Sprintf("Successfully created file %s", filePath), nil
-}
-
-func Grep(input json.RawMessage) (string, error) {
+func Grep(ctx context.Context, input json.RawMessage) (string, error) {
 	grepInput := GrepInput{}
 	err := json.Unmarshal(input, &grepInput)
 	if err != nil {
@@ -659,11 +1097,10 @@ func Grep(input json.RawMessage) (string, error) {
 	}
 
 	// Create path filter based on user options
-	filter := &DefaultPathFilter{
-		IncludeGit:     grepInput.IncludeGit,
-		IncludeHidden:  grepInput.IncludeHidden,
-		CustomExcludes: grepInput.Exclude,
-	}
+	filter := NewDefaultPathFilter()
+	filter.IncludeGit = grepInput.IncludeGit
+	filter.IncludeHidden = grepInput.IncludeHidden
+	filter.CustomExcludes = append(filter.CustomExcludes, grepInput.Exclude...)
 
 	// Store matches as a slice of map entries for JSON serialization
 	type Match struct {
@@ -678,6 +1115,10 @@ func Grep(input json.RawMessage) (string, error) {
 		if err != nil {
 			return err
 		}
+		// Stop searching if the tool call was interrupted
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
 		// Get relative path
 		relPath, err := filepath.Rel(searchDir, path)
@@ -746,7 +1187,7 @@ func Grep(input json.RawMessage) (string, error) {
 	return string(result), nil
 }
 
-func ExecuteCommand(input json.RawMessage) (string, error) {
+func ExecuteCommand(ctx context.Context, input json.RawMessage) (string, error) {
 	executeCommandInput := ExecuteCommandInput{}
 	err := json.Unmarshal(input, &executeCommandInput)
 	if err != nil {
@@ -767,28 +1208,26 @@ func ExecuteCommand(input json.RawMessage) (string, error) {
 		timeout = 300
 	}
 
+	// Create a context with timeout. It is derived from the caller's context
+	// so that interrupting the tool call stops the command too.
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
 	// Define shell to use based on OS
 	var cmd *exec.Cmd
 	if os.PathSeparator == '/' { // Unix-like
-		cmd = exec.Command("bash", "-c", executeCommandInput.Command)
+		cmd = exec.CommandContext(ctx, "bash", "-c", executeCommandInput.Command)
 	} else { // Windows
-		cmd = exec.Command("cmd", "/C", executeCommandInput.Command)
+		cmd = exec.CommandContext(ctx, "cmd", "/C", executeCommandInput.Command)
 	}
+	// Kill everything the command started, not just the shell
+	killProcessGroupOnCancel(cmd)
 
 	// Capture stdout and stderr
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-	defer cancel()
-
-	// Make the command use the context
-	cmd = exec.CommandContext(ctx, cmd.Path, cmd.Args[1:]...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
 	// Run the command
 	err = cmd.Run()
 
@@ -801,11 +1240,14 @@ func ExecuteCommand(input json.RawMessage) (string, error) {
 
 	exitCode := 0
 	if err != nil {
-		// Try to get the exit code
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		} else if ctx.Err() == context.DeadlineExceeded {
+		// A cancelled command is killed, so check the context before the exit code
+		if ctx.Err() == context.DeadlineExceeded {
 			return "", fmt.Errorf("command timed out after %d seconds", timeout)
+		} else if ctx.Err() != nil {
+			return "", fmt.Errorf("command interrupted: %w", ctx.Err())
+		} else if exitErr, ok := err.(*exec.ExitError); ok {
+			// Try to get the exit code
+			exitCode = exitErr.ExitCode()
 		} else {
 			return "", fmt.Errorf("failed to execute command: %w", err)
 		}
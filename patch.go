@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Most context lines a hunk may ignore at either end
+const maxPatchFuzz = 3
+
+// The apply patch tool
+var ApplyPatchDefinition = ToolDefinition{
+	Name: "apply_patch",
+	Description: `Apply a unified diff, like the output of git diff, to one or more files.
+
+Files are created with a "--- /dev/null" header, deleted with "+++ /dev/null" and renamed with different old and new paths (or git's "rename from" and "rename to" lines). Give each hunk a few lines of unchanged context. The line numbers in the @@ headers are only a hint, so hunks still apply if the lines have moved.
+
+By default the patch is all or nothing: if any hunk doesn't apply, no file is changed, and the result reports every hunk along with the actual content near the rejected ones. For a small change to a single file, edit_file is simpler.`,
+	InputSchema: ApplyPatchInputSchema,
+	Function:    ApplyPatch,
+	Concurrency: ConcurrencyExclusive,
+}
+
+type ApplyPatchInput struct {
+	Patch            string `json:"patch" jsonschema_description:"The unified diff to apply. Paths are relative to the working directory; git's a/ and b/ prefixes are removed."`
+	Fuzz             int    `json:"fuzz,omitempty" jsonschema_description:"Optional number of context lines at the beginning and end of a hunk that may be ignored if the hunk doesn't match otherwise, like patch --fuzz. Defaults to 0, at most 3."`
+	IgnoreWhitespace bool   `json:"ignore_whitespace,omitempty" jsonschema_description:"Set to true to match context and removed lines regardless of whitespace and indentation. Defaults to false."`
+	Partial          bool   `json:"partial,omitempty" jsonschema_description:"Set to true to change the files whose hunks all apply even if hunks of other files are rejected. Defaults to false."`
+}
+
+var ApplyPatchInputSchema = GenerateSchema[ApplyPatchInput]()
+
+// filePatch is the part of a patch that changes one file
+type filePatch struct {
+	// OldPath and NewPath are empty for a file that is created or deleted
+	OldPath string
+	NewPath string
+	Hunks   []hunk
+	// headerSeen is set once the --- and +++ lines have been parsed
+	headerSeen bool
+}
+
+// hunk is a run of changed lines with their context
+type hunk struct {
+	Header string
+	// OldStart is the line number the hunk starts at in the old file, or 0
+	// if the header has no line numbers, in which case the whole file is
+	// searched
+	OldStart int
+	// OldCount is the number of old lines the header announces, or -1
+	OldCount int
+	Lines    []hunkLine
+	// OldNoEOL and NewNoEOL are set when the old or new file ends with the
+	// hunk without a final newline
+	OldNoEOL bool
+	NewNoEOL bool
+}
+
+// hunkLine is a line of a hunk. Kind is ' ' for context, '-' for a removed
+// line and '+' for an added one.
+type hunkLine struct {
+	Kind byte
+	Text string
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parsePatch splits a unified diff into the changes to each file. Text that
+// isn't part of a file's diff, such as a commit message, is ignored.
+func parsePatch(text string) ([]*filePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	patches := []*filePatch{}
+	var current *filePatch
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			current = &filePatch{}
+			patches = append(patches, current)
+			rest := strings.TrimPrefix(line, "diff --git ")
+			if split := strings.Index(rest, " b/"); split >= 0 {
+				current.OldPath, current.NewPath = rest[:split], rest[split+1:]
+			}
+		case isFileHeader(lines, i):
+			if current == nil || current.headerSeen {
+				current = &filePatch{}
+				patches = append(patches, current)
+			}
+			current.OldPath = parsePatchPath(lines[i][len("--- "):])
+			current.NewPath = parsePatchPath(lines[i+1][len("+++ "):])
+			current.headerSeen = true
+			i++
+		case current != nil && strings.HasPrefix(line, "new file mode"):
+			current.OldPath = ""
+		case current != nil && strings.HasPrefix(line, "deleted file mode"):
+			current.NewPath = ""
+		case current != nil && strings.HasPrefix(line, "rename from "):
+			current.OldPath = parsePatchPath(strings.TrimPrefix(line, "rename from "))
+		case current != nil && strings.HasPrefix(line, "rename to "):
+			current.NewPath = parsePatchPath(strings.TrimPrefix(line, "rename to "))
+		case strings.HasPrefix(line, "GIT binary patch"), strings.HasPrefix(line, "Binary files "):
+			return nil, fmt.Errorf("line %d: binary patches aren't supported", i+1)
+		case strings.HasPrefix(line, "@@"):
+			if current == nil {
+				return nil, fmt.Errorf("line %d: the hunk comes before any --- and +++ file header", i+1)
+			}
+			h, next := parseHunk(lines, i)
+			current.Hunks = append(current.Hunks, h)
+			i = next - 1
+		}
+	}
+
+	for _, patch := range patches {
+		// git prefixes the old path with a/ and the new one with b/
+		if (patch.OldPath == "" || strings.HasPrefix(patch.OldPath, "a/")) && (patch.NewPath == "" || strings.HasPrefix(patch.NewPath, "b/")) {
+			patch.OldPath = strings.TrimPrefix(patch.OldPath, "a/")
+			patch.NewPath = strings.TrimPrefix(patch.NewPath, "b/")
+		}
+		if patch.OldPath == "" && patch.NewPath == "" {
+			return nil, fmt.Errorf("a file in the patch has no path")
+		}
+		for _, path := range []*string{&patch.OldPath, &patch.NewPath} {
+			if *path != "" {
+				*path = filepath.Clean(*path)
+			}
+		}
+	}
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no file changes found; the patch should be a unified diff with --- and +++ file headers and @@ hunks")
+	}
+	return patches, nil
+}
+
+// isFileHeader reports whether lines[i] starts a --- and +++ file header
+func isFileHeader(lines []string, i int) bool {
+	return strings.HasPrefix(lines[i], "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ")
+}
+
+// parsePatchPath extracts the path from a file header, which may be quoted
+// and followed by a timestamp. /dev/null becomes an empty path.
+func parsePatchPath(text string) string {
+	path, _, _ := strings.Cut(text, "\t")
+	path = strings.TrimSpace(path)
+	if unquoted, err := strconv.Unquote(path); err == nil {
+		path = unquoted
+	}
+	if path == "/dev/null" {
+		return ""
+	}
+	return path
+}
+
+// parseHunk parses the hunk whose header is lines[start]. It returns the hunk
+// and the index of the first line after it.
+func parseHunk(lines []string, start int) (hunk, int) {
+	h := hunk{Header: lines[start], OldCount: -1}
+	oldRemaining, newRemaining := -1, -1
+	if match := hunkHeader.FindStringSubmatch(lines[start]); match != nil {
+		h.OldStart, _ = strconv.Atoi(match[1])
+		oldRemaining, newRemaining = 1, 1
+		if match[2] != "" {
+			oldRemaining, _ = strconv.Atoi(match[2])
+		}
+		if match[4] != "" {
+			newRemaining, _ = strconv.Atoi(match[4])
+		}
+		h.OldCount = oldRemaining
+	}
+
+	i := start + 1
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "diff --git ") {
+			break
+		}
+		// A file header ends the hunk once its lines are complete, or when
+		// it is clearly followed by a hunk
+		if isFileHeader(lines, i) && ((oldRemaining <= 0 && newRemaining <= 0) || (i+2 < len(lines) && strings.HasPrefix(lines[i+2], "@@"))) {
+			break
+		}
+		if line == "" {
+			// Editors and models often drop the space of empty context lines
+			line = " "
+		}
+		switch line[0] {
+		case ' ', '-', '+':
+			h.Lines = append(h.Lines, hunkLine{Kind: line[0], Text: line[1:]})
+			if line[0] != '+' {
+				oldRemaining--
+			}
+			if line[0] != '-' {
+				newRemaining--
+			}
+		case '\\':
+			if len(h.Lines) > 0 {
+				switch h.Lines[len(h.Lines)-1].Kind {
+				case '-':
+					h.OldNoEOL = true
+				case '+':
+					h.NewNoEOL = true
+				default:
+					h.OldNoEOL, h.NewNoEOL = true, true
+				}
+			}
+		default:
+			return h.trimmed(), i
+		}
+	}
+	return h.trimmed(), i
+}
+
+// trimmed drops empty context lines from the end of a hunk that the header
+// doesn't account for, which are usually blank lines after the patch
+func (h hunk) trimmed() hunk {
+	for len(h.Lines) > 0 {
+		last := h.Lines[len(h.Lines)-1]
+		if last.Kind != ' ' || last.Text != "" || (h.OldCount >= 0 && len(h.oldLines()) <= h.OldCount) {
+			break
+		}
+		h.Lines = h.Lines[:len(h.Lines)-1]
+	}
+	return h
+}
+
+// oldLines returns the lines the hunk expects in the file
+func (h hunk) oldLines() []string {
+	lines := []string{}
+	for _, line := range h.Lines {
+		if line.Kind != '+' {
+			lines = append(lines, line.Text)
+		}
+	}
+	return lines
+}
+
+// context counts the context lines at the beginning and end of the hunk
+func (h hunk) context() (leading, trailing int) {
+	for leading < len(h.Lines) && h.Lines[leading].Kind == ' ' {
+		leading++
+	}
+	for trailing < len(h.Lines)-leading && h.Lines[len(h.Lines)-1-trailing].Kind == ' ' {
+		trailing++
+	}
+	return leading, trailing
+}
+
+// textLines is the content of a text file as lines without their line
+// endings
+type textLines struct {
+	Lines []string
+	// FinalNewline is set if the last line ends with a newline
+	FinalNewline bool
+	// CRLF is set for files with Windows line endings
+	CRLF bool
+}
+
+func splitTextLines(content string) textLines {
+	text := textLines{FinalNewline: true, CRLF: strings.Contains(content, "\r\n")}
+	if text.CRLF {
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+	}
+	if content == "" {
+		return text
+	}
+	text.FinalNewline = strings.HasSuffix(content, "\n")
+	text.Lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	return text
+}
+
+func (t textLines) String() string {
+	if len(t.Lines) == 0 {
+		return ""
+	}
+	newline := "\n"
+	if t.CRLF {
+		newline = "\r\n"
+	}
+	content := strings.Join(t.Lines, newline)
+	if t.FinalNewline {
+		content += newline
+	}
+	return content
+}
+
+// hunkOptions are the ways a hunk may differ from the file it applies to
+type hunkOptions struct {
+	Fuzz             int
+	IgnoreWhitespace bool
+}
+
+// hunkResult is where and how a hunk applied
+type hunkResult struct {
+	// Line is the 1-based line of the file the hunk matched at
+	Line int
+	// Offset is how many lines away from its header's position it applied
+	Offset int
+	// Fuzz is how many context lines were ignored at either end
+	Fuzz int
+}
+
+// hunkApplier applies the hunks of one file in order, keeping track of how
+// far earlier hunks have moved the lines of later ones
+type hunkApplier struct {
+	text    textLines
+	options hunkOptions
+	// delta is the difference between line numbers in the file as patched
+	// so far and those in the hunk headers
+	delta int
+	// next is the first line index a later hunk may change
+	next int
+}
+
+// apply finds where h matches and applies it
+func (a *hunkApplier) apply(h hunk) (hunkResult, error) {
+	old := h.oldLines()
+	expected := h.OldStart - 1
+	if len(old) == 0 {
+		// A hunk without old lines inserts after its start line
+		expected = h.OldStart
+	}
+	expected = min(max(expected+a.delta, a.next), len(a.text.Lines))
+
+	leading, trailing := h.context()
+	for fuzz := 0; fuzz <= a.options.Fuzz; fuzz++ {
+		skipStart, skipEnd := min(fuzz, leading), min(fuzz, trailing)
+		if fuzz > 0 && skipStart+skipEnd == 0 {
+			break
+		}
+		lines := h.Lines[skipStart : len(h.Lines)-skipEnd]
+		wanted := old[skipStart : len(old)-skipEnd]
+		if len(wanted) == 0 && len(old) > 0 {
+			break
+		}
+		position, ok := a.find(wanted, expected+skipStart)
+		if !ok {
+			continue
+		}
+
+		// Context lines keep what the file has, which differs from the
+		// hunk when whitespace is ignored
+		replacement := []string{}
+		i := position
+		for _, line := range lines {
+			switch line.Kind {
+			case ' ':
+				replacement = append(replacement, a.text.Lines[i])
+				i++
+			case '-':
+				i++
+			case '+':
+				replacement = append(replacement, line.Text)
+			}
+		}
+		atEnd := i == len(a.text.Lines)
+		a.text.Lines = append(a.text.Lines[:position:position], append(replacement, a.text.Lines[i:]...)...)
+		if atEnd && skipEnd == 0 {
+			if h.NewNoEOL {
+				a.text.FinalNewline = false
+			} else if h.OldNoEOL {
+				a.text.FinalNewline = true
+			}
+		}
+
+		offset := position - (expected + skipStart)
+		a.delta += offset + len(replacement) - len(wanted)
+		a.next = position + len(replacement)
+		return hunkResult{Line: position + 1, Offset: offset, Fuzz: fuzz}, nil
+	}
+	return hunkResult{}, fmt.Errorf("its context and removed lines weren't found%s", a.nearby(old, expected))
+}
+
+// find returns the index of the lines matching wanted that is closest to
+// expected, without going back before the lines earlier hunks changed
+func (a *hunkApplier) find(wanted []string, expected int) (int, bool) {
+	last := len(a.text.Lines) - len(wanted)
+	for distance := 0; expected-distance >= a.next || expected+distance <= last; distance++ {
+		for _, position := range []int{expected + distance, expected - distance} {
+			if position >= a.next && position <= last && a.matches(wanted, position) {
+				return position, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (a *hunkApplier) matches(wanted []string, position int) bool {
+	for i, line := range wanted {
+		actual := a.text.Lines[position+i]
+		if a.options.IgnoreWhitespace {
+			line, actual = normalizeSpace(line), normalizeSpace(actual)
+		}
+		if line != actual {
+			return false
+		}
+	}
+	return true
+}
+
+// nearby shows the content of the file where a rejected hunk was meant to
+// apply: the most similar lines if there are any, or else the lines around
+// its expected position
+func (a *hunkApplier) nearby(old []string, expected int) string {
+	if len(old) == 0 {
+		return ""
+	}
+	if candidates := describeCandidates(strings.Join(a.text.Lines, "\n"), strings.Join(old, "\n")); candidates != "" {
+		return candidates
+	}
+	first := max(expected-2, 0)
+	last := min(expected+len(old)+2, len(a.text.Lines))
+	if first >= last {
+		return ""
+	}
+	var text strings.Builder
+	fmt.Fprintf(&text, ". Lines %d-%d of the file are:\n", first+1, last)
+	for i := first; i < last; i++ {
+		fmt.Fprintf(&text, "%6d\t%s\n", i+1, a.text.Lines[i])
+	}
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+// patchedFile is the state of a file while a patch is applied in memory
+type patchedFile struct {
+	Content  string
+	Encoding textEncoding
+	Exists   bool
+	// Existed is whether the file existed before the patch
+	Existed bool
+	// Changed is set once the patch has created, changed or deleted the file
+	Changed bool
+}
+
+// patchWorkspace holds the files a patch touches until it is written out
+type patchWorkspace struct {
+	files map[string]*patchedFile
+	// order lists the paths in the order they were first touched
+	order []string
+}
+
+// file returns the state of path, loading it on first use
+func (w *patchWorkspace) file(path string) (*patchedFile, error) {
+	if file, ok := w.files[path]; ok {
+		return file, nil
+	}
+	content, encoding, err := readTextFile(path)
+	file := &patchedFile{Content: content, Encoding: encoding, Exists: err == nil, Existed: err == nil}
+	if os.IsNotExist(err) {
+		file.Encoding = utf8Encoding
+	} else if err != nil {
+		return nil, err
+	}
+	w.files[path] = file
+	w.order = append(w.order, path)
+	return file, nil
+}
+
+// fileReport describes what happened to one file of a patch
+type fileReport struct {
+	Name   string
+	Action string
+	// Hunks has a line per hunk
+	Hunks  []string
+	Failed bool
+	// Paths are the files the change affects
+	Paths []string
+}
+
+func (r fileReport) String() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "- %s: %s", r.Name, r.Action)
+	for _, hunk := range r.Hunks {
+		for _, line := range strings.Split(hunk, "\n") {
+			if line != "" {
+				line = "  " + line
+			}
+			text.WriteString("\n" + line)
+		}
+	}
+	return text.String()
+}
+
+// applyFilePatch applies the change to one file to the workspace
+func (w *patchWorkspace) applyFilePatch(patch *filePatch, options hunkOptions) fileReport {
+	report := fileReport{Name: patch.NewPath, Paths: []string{patch.OldPath, patch.NewPath}}
+	source := patch.OldPath
+	switch {
+	case patch.OldPath == "":
+		report.Action, source = "created", ""
+		report.Paths = []string{patch.NewPath}
+	case patch.NewPath == "":
+		report.Name, report.Action = patch.OldPath, "deleted"
+		report.Paths = []string{patch.OldPath}
+	case patch.OldPath != patch.NewPath:
+		report.Action = "renamed from " + patch.OldPath
+	default:
+		report.Action = "modified"
+		report.Paths = []string{patch.NewPath}
+	}
+	fail := func(reason string) fileReport {
+		report.Action, report.Failed = "rejected, "+reason, true
+		return report
+	}
+
+	// Read the file being changed and check the target is free
+	content, encoding := "", utf8Encoding
+	if source != "" {
+		file, err := w.file(source)
+		if err != nil {
+			return fail(err.Error())
+		}
+		if !file.Exists {
+			return fail("the file doesn't exist")
+		}
+		content, encoding = file.Content, file.Encoding
+	}
+	var target *patchedFile
+	if patch.NewPath != "" {
+		file, err := w.file(patch.NewPath)
+		if err != nil {
+			return fail(err.Error())
+		}
+		if file.Exists && source != patch.NewPath {
+			return fail("the file already exists")
+		}
+		target = file
+	}
+
+	applier := hunkApplier{text: splitTextLines(content), options: options}
+	failed := 0
+	for i, h := range patch.Hunks {
+		result, err := applier.apply(h)
+		status := ""
+		switch {
+		case err != nil:
+			failed++
+			status = "rejected, " + err.Error()
+		default:
+			// Like patch, mention how far the hunk moved and how much
+			// context was ignored
+			status = fmt.Sprintf("applied at line %d", result.Line)
+			details := []string{}
+			if result.Offset != 0 {
+				details = append(details, fmt.Sprintf("offset %+d", result.Offset))
+			}
+			if result.Fuzz != 0 {
+				details = append(details, fmt.Sprintf("fuzz %d", result.Fuzz))
+			}
+			if len(details) > 0 {
+				status += " (" + strings.Join(details, ", ") + ")"
+			}
+		}
+		report.Hunks = append(report.Hunks, fmt.Sprintf("hunk %d (%s): %s", i+1, h.Header, status))
+	}
+	if failed > 0 {
+		return fail(fmt.Sprintf("%d of %d hunks didn't apply", failed, len(patch.Hunks)))
+	}
+	if patch.NewPath == "" && len(patch.Hunks) > 0 && len(applier.text.Lines) > 0 {
+		return fail("the patch doesn't remove all of the file's lines")
+	}
+
+	// Record the result
+	if source != "" && patch.NewPath != source {
+		file, _ := w.file(source)
+		file.Exists, file.Content, file.Changed = false, "", true
+	}
+	if target != nil {
+		target.Exists, target.Content, target.Encoding, target.Changed = true, applier.text.String(), encoding, true
+	}
+	return report
+}
+
+// write saves the patched files, leaving out the given paths. The new
+// contents are written to temporary files first and only moved into place
+// once every file was written, so that a failure doesn't leave the patch
+// half-applied.
+func (w *patchWorkspace) write(skip map[string]bool) error {
+	type stagedFile struct{ temp, path string }
+	staged := []stagedFile{}
+	// Whatever wasn't moved into place is cleaned up
+	defer func() {
+		for _, file := range staged {
+			os.Remove(file.temp)
+		}
+	}()
+	removed := []string{}
+	for _, path := range w.order {
+		file := w.files[path]
+		if !file.Changed || skip[path] {
+			continue
+		}
+		switch {
+		case file.Exists:
+			target, temp, err := stageFile(path, file)
+			if err != nil {
+				return fmt.Errorf("failed to write %s, so no files were changed: %w", path, err)
+			}
+			staged = append(staged, stagedFile{temp, target})
+		case file.Existed:
+			removed = append(removed, path)
+		}
+	}
+
+	for _, file := range staged {
+		if err := os.Rename(file.temp, file.path); err != nil {
+			return err
+		}
+	}
+	for _, path := range removed {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageFile writes the patched content of path to a temporary file in the
+// same directory, with the permissions of the file it replaces. It returns
+// the path the temporary file is to be renamed to, which is where a symlink
+// points, and the temporary file's path.
+func stageFile(path string, file *patchedFile) (string, string, error) {
+	data, err := file.Encoding.encode(file.Content)
+	if err != nil {
+		return "", "", err
+	}
+	target, mode := path, os.FileMode(0644)
+	if file.Existed {
+		if target, err = filepath.EvalSymlinks(path); err != nil {
+			return "", "", err
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			return "", "", err
+		}
+		mode = info.Mode().Perm()
+	} else if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return "", "", err
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", "", err
+	}
+	return target, temp.Name(), nil
+}
+
+// ApplyPatch applies a unified diff to the files it names
+func ApplyPatch(ctx context.Context, input json.RawMessage) (string, error) {
+	applyPatchInput := ApplyPatchInput{}
+	if err := json.Unmarshal(input, &applyPatchInput); err != nil {
+		return "", err
+	}
+	if applyPatchInput.Fuzz < 0 || applyPatchInput.Fuzz > maxPatchFuzz {
+		return "", fmt.Errorf("fuzz must be between 0 and %d", maxPatchFuzz)
+	}
+	patches, err := parsePatch(applyPatchInput.Patch)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the patch: %w", err)
+	}
+
+	options := hunkOptions{Fuzz: applyPatchInput.Fuzz, IgnoreWhitespace: applyPatchInput.IgnoreWhitespace}
+	workspace := &patchWorkspace{files: map[string]*patchedFile{}}
+	reports := []string{}
+	failedPaths := map[string]bool{}
+	failed := 0
+	for _, patch := range patches {
+		report := workspace.applyFilePatch(patch, options)
+		reports = append(reports, report.String())
+		if report.Failed {
+			failed++
+			for _, path := range report.Paths {
+				failedPaths[path] = true
+			}
+		}
+	}
+
+	if failed == 0 {
+		if err := workspace.write(nil); err != nil {
+			return "", err
+		}
+		return "Applied the patch:\n" + strings.Join(reports, "\n"), nil
+	}
+	if !applyPatchInput.Partial {
+		return "", fmt.Errorf("the patch was not applied and no files were changed, because %d of %d file changes had problems:\n%s", failed, len(patches), strings.Join(reports, "\n"))
+	}
+	if err := workspace.write(failedPaths); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("the patch was applied in part: %d of %d file changes had problems and their files were left unchanged:\n%s", failed, len(patches), strings.Join(reports, "\n"))
+}
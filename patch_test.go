@@ -0,0 +1,236 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+const patchSource = "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hello\")\n}\n"
+
+func TestApplyPatch(t *testing.T) {
+	useWorkspace(t, map[string]string{
+		"main.go":   patchSource,
+		"old.txt":   "remove me\n",
+		"util.go":   "package main\n\nfunc util() {}\n",
+		"notes.txt": "first\r\nsecond\r\n",
+	})
+
+	// The main.go hunk's header is two lines off
+	patch := `Rework the program
+
+diff --git a/main.go b/main.go
+--- a/main.go
++++ b/main.go
+@@ -3,4 +3,4 @@ import "fmt"
+ func main() {
+-	fmt.Println("hello")
++	fmt.Println(greeting())
+ }
+diff --git a/greeting.go b/greeting.go
+new file mode 100644
+--- /dev/null
++++ b/greeting.go
+@@ -0,0 +1,3 @@
++package main
++
++func greeting() string { return "hello" }
+diff --git a/old.txt b/old.txt
+deleted file mode 100644
+--- a/old.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-remove me
+diff --git a/util.go b/internal/util.go
+similarity index 80%
+rename from util.go
+rename to internal/util.go
+--- a/util.go
++++ b/internal/util.go
+@@ -3 +3 @@
+-func util() {}
++func util() { fmt.Println() }
+\ No newline at end of file
+--- notes.txt
++++ notes.txt
+@@ -1,2 +1,2 @@
+ first
+-second
++third
+`
+
+	runScript(t, builtinTools, "Rework the program",
+		Turn{Calls: []Call{{"apply_patch", map[string]any{"patch": patch}}}},
+		Turn{
+			Expect: []Result{{Contains: `Applied the patch:
+- main.go: modified
+  hunk 1 (@@ -3,4 +3,4 @@ import "fmt"): applied at line 5 (offset +2)
+- greeting.go: created
+  hunk 1 (@@ -0,0 +1,3 @@): applied at line 1
+- old.txt: deleted
+  hunk 1 (@@ -1 +0,0 @@): applied at line 1
+- internal/util.go: renamed from util.go
+  hunk 1 (@@ -3 +3 @@): applied at line 3
+- notes.txt: modified
+  hunk 1 (@@ -1,2 +1,2 @@): applied at line 1`}},
+			Text: "Done.",
+		},
+	)
+
+	assertFile(t, "main.go", "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(greeting())\n}\n")
+	assertFile(t, "greeting.go", "package main\n\nfunc greeting() string { return \"hello\" }\n")
+	assertFile(t, "internal/util.go", "package main\n\nfunc util() { fmt.Println() }")
+	assertFile(t, "notes.txt", "first\r\nthird\r\n")
+	for _, path := range []string{"old.txt", "util.go"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", path, err)
+		}
+	}
+}
+
+func TestApplyPatchRejection(t *testing.T) {
+	useWorkspace(t, map[string]string{"main.go": patchSource, "other.go": "package main\n"})
+
+	patch := `--- /dev/null
++++ b/README.md
+@@ -0,0 +1 @@
++# Patched
+--- a/other.go
++++ b/other.go
+@@ -1 +1,2 @@
+ package main
++// Other things
+--- a/main.go
++++ b/main.go
+@@ -5,3 +5,3 @@
+ func main() {
+-	fmt.Println("hi")
++	fmt.Println("bye")
+ }
+--- a/new.go
++++ b/new.go
+@@ -1 +1 @@
+-package new
++package main
+--- /dev/null
++++ b/other.go
+@@ -0,0 +1 @@
++package main
+`
+	runScript(t, builtinTools, "Patch it",
+		Turn{Calls: []Call{{"apply_patch", map[string]any{"patch": patch}}}},
+		Turn{
+			Expect: []Result{{
+				Contains: `the patch was not applied and no files were changed, because 3 of 5 file changes had problems:
+- README.md: created
+  hunk 1 (@@ -0,0 +1 @@): applied at line 1
+- other.go: modified
+  hunk 1 (@@ -1 +1,2 @@): applied at line 1
+- main.go: rejected, 1 of 1 hunks didn't apply
+  hunk 1 (@@ -5,3 +5,3 @@): rejected, its context and removed lines weren't found. The closest matches, ignoring whitespace and indentation, are:
+
+  Lines 5-7:
+       5	func main() {
+       6		fmt.Println("hello")
+       7	}
+
+  Copy the text exactly from the file, without the line numbers.
+- new.go: rejected, the file doesn't exist
+- other.go: rejected, the file already exists`,
+				IsError: true,
+			}},
+			Calls: []Call{{"apply_patch", map[string]any{"patch": patch, "partial": true}}},
+		},
+		Turn{
+			Expect: []Result{{Contains: "the patch was applied in part: 3 of 5 file changes had problems and their files were left unchanged", IsError: true}},
+			Text:   "Done.",
+		},
+	)
+
+	assertFile(t, "README.md", "# Patched\n")
+	// The second other.go change failed, so the first one isn't written either
+	assertFile(t, "other.go", "package main\n")
+	assertFile(t, "main.go", patchSource)
+}
+
+func TestApplyPatchWriteFailure(t *testing.T) {
+	useWorkspace(t, map[string]string{
+		"main.go":    patchSource,
+		"legacy.txt": "caf\xe9\n",
+		"old.txt":    "remove me\n",
+	})
+
+	// legacy.txt is windows-1252, which has no check mark
+	patch := `--- a/main.go
++++ b/main.go
+@@ -6 +6 @@
+-	fmt.Println("hello")
++	fmt.Println("bye")
+--- a/legacy.txt
++++ b/legacy.txt
+@@ -1 +1 @@
+-café
++café ✓
+--- a/old.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-remove me
+`
+	runScript(t, builtinTools, "Patch it",
+		Turn{Calls: []Call{{"apply_patch", map[string]any{"patch": patch}}}},
+		Turn{
+			Expect: []Result{{
+				Contains: "failed to write legacy.txt, so no files were changed: the file is encoded as windows-1252, which can't represent the new text",
+				IsError:  true,
+			}},
+			Text: "Done.",
+		},
+	)
+
+	assertFile(t, "main.go", patchSource)
+	assertFile(t, "legacy.txt", "caf\xe9\n")
+	assertFile(t, "old.txt", "remove me\n")
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
+
+func TestApplyPatchFuzz(t *testing.T) {
+	useWorkspace(t, map[string]string{"main.go": patchSource})
+
+	// The first context line is wrong and the rest differ in indentation
+	patch := `--- main.go
++++ main.go
+@@ -4,4 +4,4 @@
+ func run() {
+-  fmt.Println("hello")
++	fmt.Println("hello, world")
+ }
+`
+	runScript(t, builtinTools, "Patch it",
+		Turn{Calls: []Call{
+			{"apply_patch", map[string]any{"patch": patch, "fuzz": 1}},
+			{"apply_patch", map[string]any{"patch": patch, "ignore_whitespace": true}},
+			{"apply_patch", map[string]any{"patch": patch, "fuzz": 4}},
+			{"apply_patch", map[string]any{"patch": "just some text"}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "hunk 1 (@@ -4,4 +4,4 @@): rejected", IsError: true},
+				{Contains: "hunk 1 (@@ -4,4 +4,4 @@): rejected", IsError: true},
+				{Contains: "fuzz must be between 0 and 3", IsError: true},
+				{Contains: "failed to parse the patch: no file changes found", IsError: true},
+			},
+			Calls: []Call{{"apply_patch", map[string]any{"patch": patch, "fuzz": 1, "ignore_whitespace": true}}},
+		},
+		Turn{
+			Expect: []Result{{Contains: "hunk 1 (@@ -4,4 +4,4 @@): applied at line 6 (offset +1, fuzz 1)"}},
+			Text:   "Done.",
+		},
+	)
+
+	assertFile(t, "main.go", "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hello, world\")\n}\n")
+}
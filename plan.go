@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Name of the tool the model submits its plan with in plan mode
+const submitPlanToolName = "submit_plan"
+
+// Added to the system prompt while plan mode is on
+const planModePrompt = `Plan mode is on: you can only use tools that don't change anything. Investigate what you need to, then call submit_plan with a concrete, step by step plan for the user to review. Don't try to make changes until the plan has been approved.`
+
+// Added to the system prompt once a plan has been approved, so that it stays
+// in context even when the conversation is compacted
+const approvedPlanPrompt = "The user approved the following plan. Carry it out, and tell the user before deviating from it."
+
+type PlanStep struct {
+	Description string   `json:"description" jsonschema_description:"What will be done in this step"`
+	Files       []string `json:"files,omitempty" jsonschema_description:"Optional paths of the files the step will create or change"`
+}
+
+type PlanInput struct {
+	Summary string     `json:"summary" jsonschema_description:"One or two sentences on what the plan achieves and how"`
+	Steps   []PlanStep `json:"steps" jsonschema_description:"The steps of the plan, in the order they will be carried out"`
+}
+
+var PlanInputSchema = GenerateSchema[PlanInput]()
+
+// SetPlanMode switches plan mode on or off. In plan mode only tools that
+// don't modify anything are offered to the model, along with submit_plan.
+func (a *Agent) SetPlanMode(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.planMode = enabled
+}
+
+// inPlanMode reports whether plan mode is on
+func (a *Agent) inPlanMode() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.planMode
+}
+
+// approvePlan pins the plan in context and leaves plan mode
+func (a *Agent) approvePlan(plan string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.planMode = false
+	a.approvedPlan = plan
+}
+
+// clearPlan drops the approved plan, e.g. when the conversation is cleared
+func (a *Agent) clearPlan() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.approvedPlan = ""
+}
+
+// activeTools returns the tools currently offered to the model
+func (a *Agent) activeTools() []ToolDefinition {
+	if !a.inPlanMode() {
+		return a.tools
+	}
+	tools := []ToolDefinition{}
+	for _, tool := range a.tools {
+		if isReadOnlyTool(tool) {
+			tools = append(tools, tool)
+		}
+	}
+	return append(tools, a.submitPlanDefinition())
+}
+
+// isReadOnlyTool reports whether a tool never modifies anything
+func isReadOnlyTool(tool ToolDefinition) bool {
+	return tool.Concurrency == ConcurrencyReadOnly || tool.Concurrency == ConcurrencyReadsPath
+}
+
+// planModeRejection returns why a call to the named tool is refused in plan
+// mode, or an empty string if it isn't
+func (a *Agent) planModeRejection(name string) string {
+	if !a.inPlanMode() {
+		return ""
+	}
+	for _, tool := range a.tools {
+		if tool.Name == name && !isReadOnlyTool(tool) {
+			return fmt.Sprintf("%s may modify files, so it isn't available in plan mode. Use the read-only tools to investigate and call %s with your plan.", name, submitPlanToolName)
+		}
+	}
+	return ""
+}
+
+// requestSystemPrompt returns the system prompt for the next request, with
+// the plan mode instructions or the approved plan added
+func (a *Agent) requestSystemPrompt() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sections := []string{}
+	if a.systemPrompt != "" {
+		sections = append(sections, a.systemPrompt)
+	}
+	if a.planMode {
+		sections = append(sections, planModePrompt)
+	} else if a.approvedPlan != "" {
+		sections = append(sections, approvedPlanPrompt+"\n\n"+a.approvedPlan)
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// submitPlanDefinition returns the tool the model ends plan mode with
+func (a *Agent) submitPlanDefinition() ToolDefinition {
+	return ToolDefinition{
+		Name:        submitPlanToolName,
+		Description: "Submit your plan for the user to review once you have investigated enough. The user can approve it, edit it or reject it with feedback. Once approved, all tools become available to carry out the plan.",
+		InputSchema: PlanInputSchema,
+		Function:    a.submitPlan,
+		Concurrency: ConcurrencyExclusive,
+	}
+}
+
+// submitPlan shows the plan to the user and asks for approval
+func (a *Agent) submitPlan(ctx context.Context, input json.RawMessage) (string, error) {
+	planInput := PlanInput{}
+	if err := json.Unmarshal(input, &planInput); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(planInput.Summary) == "" || len(planInput.Steps) == 0 {
+		return "", fmt.Errorf("the plan needs a summary and at least one step")
+	}
+	plan := renderPlan(planInput)
+
+	// Without anyone to ask, the plan is the result of the run
+	if a.getUserMessage == nil {
+		return "The plan was recorded for the user to review. Stop here without making changes.", nil
+	}
+
+	fmt.Fprintf(a.out, "\n%s\n\n", plan)
+	answer, ok := a.getUserMessage("\u001b[96mplan\u001b[0m: Approve this plan? [y]es, [e]dit, [n]o: ")
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		a.approvePlan(plan)
+		fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Plan approved, all tools are available again")
+		return "The user approved the plan. Plan mode is off and all tools are available; carry out the plan now.", nil
+	case "e", "edit":
+		edited, err := editText(a.out, plan)
+		if err != nil {
+			return "", fmt.Errorf("failed to edit the plan: %w", err)
+		}
+		a.approvePlan(edited)
+		fmt.Fprintln(a.out, "\u001b[96minfo\u001b[0m: Edited plan approved, all tools are available again")
+		return "The user edited and approved the plan. Plan mode is off and all tools are available; carry out this version of the plan now:\n\n" + edited, nil
+	}
+
+	feedback := ""
+	if ok {
+		feedback, _ = a.getUserMessage("\u001b[96mplan\u001b[0m: What should change? ")
+	}
+	result := "The user rejected the plan. Plan mode is still on."
+	if strings.TrimSpace(feedback) != "" {
+		result += " Their feedback: " + strings.TrimSpace(feedback)
+	}
+	return result, nil
+}
+
+// renderPlan formats a plan as markdown
+func renderPlan(plan PlanInput) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "## Plan\n\n%s\n\n", strings.TrimSpace(plan.Summary))
+	for i, step := range plan.Steps {
+		fmt.Fprintf(&text, "%d. %s", i+1, strings.TrimSpace(step.Description))
+		if len(step.Files) > 0 {
+			fmt.Fprintf(&text, " (%s)", strings.Join(step.Files, ", "))
+		}
+		text.WriteString("\n")
+	}
+	return strings.TrimRight(text.String(), "\n")
+}
+
+// editText opens text in the user's editor ($VISUAL, $EDITOR or vi), which
+// shows itself on out, and returns the saved result
+func editText(out io.Writer, text string) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	file, err := os.CreateTemp("", "plan-*.md")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(text + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	// The editor setting may include arguments, e.g. "code --wait"
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], file.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(edited)) == "" {
+		return "", fmt.Errorf("the edited plan is empty")
+	}
+	return strings.TrimRight(string(edited), "\n"), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// answering returns a getUserMessage that gives each answer in turn
+func answering(answers ...string) func(string) (string, bool) {
+	return func(string) (string, bool) {
+		if len(answers) == 0 {
+			return "", false
+		}
+		answer := answers[0]
+		answers = answers[1:]
+		return answer, true
+	}
+}
+
+var testPlan = map[string]any{
+	"summary": "Add a greeting to main",
+	"steps": []map[string]any{
+		{"description": "Call greet from main", "files": []string{"main.go"}},
+	},
+}
+
+func toolNames(tools []ToolDefinition) string {
+	names := []string{}
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestPlanModeApproval(t *testing.T) {
+	useWorkspace(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"})
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{
+			{"edit_file", map[string]any{"path": "main.go", "old_str": "func main() {}", "new_str": "func main() { greet() }"}},
+			{"read_file", map[string]any{"path": "main.go"}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "edit_file may modify files, so it isn't available in plan mode", IsError: true},
+				{Contains: "func main() {}"},
+			},
+			Calls: []Call{{"submit_plan", testPlan}},
+		},
+		Turn{
+			Expect: []Result{{Contains: "The user approved the plan"}},
+			Calls:  []Call{{"edit_file", map[string]any{"path": "main.go", "old_str": "func main() {}", "new_str": "func main() { greet() }"}}},
+		},
+		Turn{Expect: []Result{{Contains: "OK"}}, Text: "Done."},
+	)
+	agent := newScriptedAgent(provider, builtinTools, "")
+	agent.getUserMessage = answering("Greet the user", "y")
+	agent.SetPlanMode(true)
+	runAgent(t, agent)
+
+	if got := toolNames(provider.requests[0].Tools); got != "read_file,list_files,grep,submit_plan" {
+		t.Errorf("plan mode tools = %s", got)
+	}
+	if !strings.Contains(provider.requests[0].System, "Plan mode is on") {
+		t.Errorf("plan mode system prompt = %q", provider.requests[0].System)
+	}
+	if got := toolNames(provider.requests[2].Tools); got != toolNames(builtinTools) {
+		t.Errorf("tools after approval = %s, want all of them", got)
+	}
+	if system := provider.requests[2].System; !strings.Contains(system, "1. Call greet from main (main.go)") {
+		t.Errorf("approved plan isn't pinned in the system prompt: %q", system)
+	}
+	assertFile(t, "main.go", "package main\n\nfunc main() { greet() }\n")
+}
+
+func TestPlanModeRejection(t *testing.T) {
+	useWorkspace(t, nil)
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{{"submit_plan", testPlan}}},
+		Turn{Expect: []Result{{Contains: "rejected the plan. Plan mode is still on. Their feedback: Use smaller steps"}}, Text: "I'll revise it."},
+	)
+	agent := newScriptedAgent(provider, builtinTools, "")
+	agent.getUserMessage = answering("Greet the user", "n", "Use smaller steps")
+	agent.SetPlanMode(true)
+	runAgent(t, agent)
+
+	if !agent.inPlanMode() {
+		t.Error("plan mode was switched off by a rejected plan")
+	}
+}
+
+func TestPlanModeEdit(t *testing.T) {
+	useWorkspace(t, nil)
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "sed -i s/greet/welcome/")
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{{"submit_plan", testPlan}, {"submit_plan", map[string]any{"summary": "Nothing"}}}},
+		Turn{
+			Expect: []Result{
+				{Contains: "1. Call welcome from main (main.go)"},
+				// Submitted after the plan was approved
+				{Contains: "tool not found", IsError: true},
+			},
+			Text: "On it.",
+		},
+	)
+	agent := newScriptedAgent(provider, builtinTools, "")
+	agent.getUserMessage = answering("Greet the user", "e")
+	agent.SetPlanMode(true)
+	runAgent(t, agent)
+
+	if agent.inPlanMode() || !strings.Contains(agent.requestSystemPrompt(), "Call welcome from main") {
+		t.Errorf("edited plan wasn't approved: %q", agent.requestSystemPrompt())
+	}
+}
+
+func TestPlanModeHeadless(t *testing.T) {
+	useWorkspace(t, nil)
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{{"submit_plan", map[string]any{"summary": "Nothing"}}, {"submit_plan", testPlan}}},
+		Turn{
+			Expect: []Result{
+				{Contains: "the plan needs a summary and at least one step", IsError: true},
+				{Contains: "recorded for the user to review"},
+			},
+			Text: "Here is the plan.",
+		},
+	)
+	agent := NewAgent(provider, nil, builtinTools, DefaultConfig(), "")
+	agent.SetPlanMode(true)
+	var out strings.Builder
+	result := agent.RunHeadless(t.Context(), "Greet the user", outputText, 0, &out)
+	if result.Subtype != "success" || !agent.inPlanMode() {
+		t.Errorf("headless plan run = %+v, plan mode %v", result, agent.inPlanMode())
+	}
+}
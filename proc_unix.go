@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killProcessGroupOnCancel runs cmd in its own process group and kills the
+// whole group when the command's context is cancelled, so that children the
+// shell started don't outlive it.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait forever on output pipes held open by stray children
+	cmd.WaitDelay = time.Second
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killProcessGroupOnCancel makes sure waiting for a cancelled command doesn't
+// hang on output pipes held open by its children. Windows has no process
+// groups to kill, so only the shell itself is terminated.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.WaitDelay = time.Second
+}
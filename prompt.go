@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// Name of the project instruction files picked up from the directory tree
+	instructionFileName = "AGENTS.md"
+	// Prefix of a line that pulls another file into an instruction file
+	includeDirective = "@include "
+	// How deeply @include directives may nest
+	maxIncludeDepth = 5
+)
+
+const basePrompt = `You are a coding agent running in the user's terminal. You help with software engineering tasks by reading, searching and editing files and by running commands with the tools you have been given.
+
+- Look at the relevant code before changing it, and match the conventions of the surrounding code.
+- Keep changes focused on what was asked.
+- Prefer the dedicated file tools over shell commands when one fits.
+- Keep your replies short; the user sees them in a terminal.`
+
+// SystemPrompt is the assembled system prompt along with the instruction
+// files that went into it, in the order they were loaded.
+type SystemPrompt struct {
+	Text  string
+	Files []string
+}
+
+// BuildSystemPrompt combines the built-in base prompt with the user level
+// instruction file and every AGENTS.md between the repository root and the
+// working directory. More specific files come later so they take precedence.
+// Files that fail to load are skipped with a warning written to out.
+func BuildSystemPrompt(out io.Writer, workingDir string) SystemPrompt {
+	prompt := SystemPrompt{}
+	sections := []string{
+		basePrompt,
+		environmentInfo(workingDir),
+	}
+
+	candidates := []string{}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(configDir, "agent", instructionFileName))
+	}
+	for _, dir := range projectDirs(workingDir) {
+		candidates = append(candidates, filepath.Join(dir, instructionFileName))
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err != nil {
+			continue
+		}
+		files := []string{}
+		content, err := loadInstructionFile(candidate, map[string]bool{}, 0, &files)
+		if err != nil {
+			fmt.Fprintf(out, "Warning: Skipping instruction file %s: %v\n", candidate, err)
+			continue
+		}
+		prompt.Files = append(prompt.Files, files...)
+		sections = append(sections, fmt.Sprintf("Instructions from %s:\n\n%s", candidate, strings.TrimSpace(content)))
+	}
+
+	prompt.Text = strings.Join(sections, "\n\n")
+	return prompt
+}
+
+// environmentInfo describes where the agent is running
+func environmentInfo(workingDir string) string {
+	return fmt.Sprintf("Working directory: %s\nPlatform: %s\nToday's date: %s", workingDir, runtime.GOOS, time.Now().Format("2006-01-02"))
+}
+
+// projectDirs returns the directories from the repository root (the nearest
+// ancestor containing .git) down to dir. Without a repository only dir itself
+// is returned.
+func projectDirs(dir string) []string {
+	dirs := []string{}
+	for current := dir; ; current = filepath.Dir(current) {
+		dirs = append([]string{current}, dirs...)
+		if _, err := os.Stat(filepath.Join(current, ".git")); err == nil {
+			return dirs
+		}
+		if filepath.Dir(current) == current {
+			return []string{dir}
+		}
+	}
+}
+
+// loadInstructionFile reads an instruction file, replacing every @include
+// line with the contents of the referenced file. Relative include paths are
+// resolved against the including file's directory.
+func loadInstructionFile(path string, visiting map[string]bool, depth int, loaded *[]string) (string, error) {
+	if depth > maxIncludeDepth {
+		return "", fmt.Errorf("%s: includes nested more than %d levels deep", path, maxIncludeDepth)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if visiting[absPath] {
+		return "", fmt.Errorf("%s: include cycle detected", path)
+	}
+	visiting[absPath] = true
+	defer delete(visiting, absPath)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read instruction file: %w", err)
+	}
+	*loaded = append(*loaded, path)
+
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, includeDirective) {
+			continue
+		}
+		includePath := strings.TrimSpace(strings.TrimPrefix(trimmed, includeDirective))
+		if strings.HasPrefix(includePath, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				includePath = filepath.Join(home, includePath[2:])
+			}
+		} else if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+		included, err := loadInstructionFile(includePath, visiting, depth+1, loaded)
+		if err != nil {
+			return "", fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		lines[i] = strings.TrimRight(included, "\n")
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// Names of the supported providers, as used in the config
+const (
+	providerAnthropic = "anthropic"
+	providerOpenAI    = "openai"
+)
+
+// Provider is a model API the agent runs inference against. Conversations are
+// kept in the Anthropic Messages format; providers that speak another API
+// translate requests and responses.
+type Provider interface {
+	// Stream starts a streaming request. Whatever the API, the response is
+	// reported as Anthropic streaming events.
+	Stream(ctx context.Context, request InferenceRequest) EventStream
+}
+
+// EventStream is a streaming response. It is implemented by the SDK's
+// ssestream.Stream and by providers that translate another API's stream.
+type EventStream interface {
+	Next() bool
+	Current() anthropic.MessageStreamEventUnion
+	Err() error
+	Close() error
+}
+
+// InferenceRequest is a provider independent inference request
+type InferenceRequest struct {
+	Model         string
+	MaxTokens     int64
+	System        string
+	Messages      []anthropic.MessageParam
+	Tools         []ToolDefinition
+	StopSequences []string
+	Temperature   *float64
+	// ThinkingBudget enables extended thinking when positive
+	ThinkingBudget int64
+}
+
+// NewProvider creates the provider selected in the config. A non-nil
+// httpClient replaces the default one, e.g. to record or replay cassettes.
+func NewProvider(config Config, httpClient *http.Client) (Provider, error) {
+	switch config.Provider {
+	case "", providerAnthropic:
+		// Retries are handled by the agent so that they can be shown in the
+		// terminal
+		options := []option.RequestOption{option.WithMaxRetries(0)}
+		if config.BaseURL != "" {
+			options = append(options, option.WithBaseURL(config.BaseURL))
+		}
+		if httpClient != nil {
+			options = append(options, option.WithHTTPClient(httpClient))
+		}
+		client := anthropic.NewClient(options...)
+		return NewAnthropicProvider(&client), nil
+	case providerOpenAI:
+		baseURL := config.BaseURL
+		if baseURL == "" {
+			baseURL = defaultOpenAIBaseURL
+		}
+		provider := NewOpenAIProvider(baseURL, os.Getenv("OPENAI_API_KEY"))
+		if httpClient != nil {
+			provider.httpClient = httpClient
+		}
+		return provider, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", config.Provider)
+}
+
+// AnthropicProvider talks to the Anthropic Messages API
+type AnthropicProvider struct {
+	client    *anthropic.Client
+	debugMode bool
+}
+
+// NewAnthropicProvider creates a provider using the given client
+func NewAnthropicProvider(client *anthropic.Client) *AnthropicProvider {
+	return &AnthropicProvider{
+		client:    client,
+		debugMode: os.Getenv("DEBUG") == "1",
+	}
+}
+
+func (p *AnthropicProvider) Stream(ctx context.Context, request InferenceRequest) EventStream {
+	tools := []anthropic.ToolUnionParam{}
+	for _, tool := range request.Tools {
+		tools = append(tools, anthropic.ToolUnionParam{
+			OfTool: &anthropic.ToolParam{
+				Name:        tool.Name,
+				Description: anthropic.String(tool.Description),
+				InputSchema: tool.InputSchema,
+			},
+		})
+	}
+	var system []anthropic.TextBlockParam
+	if request.System != "" {
+		system = []anthropic.TextBlockParam{{Text: request.System}}
+	}
+	// Let the API cache the parts of the request that repeat between calls
+	messages, breakpoints := addCacheBreakpoints(tools, system, request.Messages)
+	// The provider has no say over where the agent's output goes, so its
+	// debug output goes to stderr, which a headless result never uses
+	if p.debugMode {
+		fmt.Fprintf(os.Stderr, "\u001b[96mdebug\u001b[0m: Using %d/%d cache breakpoints\n", breakpoints, maxCacheBreakpoints)
+	}
+
+	params := anthropic.MessageNewParams{
+		Model:         anthropic.Model(request.Model),
+		MaxTokens:     request.MaxTokens,
+		Messages:      messages,
+		Tools:         tools,
+		System:        system,
+		StopSequences: request.StopSequences,
+	}
+	if request.Temperature != nil {
+		params.Temperature = anthropic.Float(*request.Temperature)
+	}
+	if request.ThinkingBudget > 0 {
+		params.Thinking = anthropic.ThinkingConfigParamOfThinkingConfigEnabled(request.ThinkingBudget)
+	}
+	return p.client.Messages.NewStreaming(ctx, params)
+}
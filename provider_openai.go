@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Base URL of the OpenAI API. Local servers are configured with base_url,
+// e.g. http://localhost:11434/v1 for Ollama or http://localhost:8080/v1 for
+// llama.cpp.
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// OpenAIProvider talks to an OpenAI-compatible chat completions API
+type OpenAIProvider struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// NewOpenAIProvider creates a provider for the API at baseURL. Local servers
+// usually don't need an API key.
+func NewOpenAIProvider(baseURL, apiKey string) *OpenAIProvider {
+	return &OpenAIProvider{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// HTTPError is an unsuccessful response from a provider's API
+type HTTPError struct {
+	StatusCode int
+	Body       string
+	Response   *http.Response
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), strings.TrimSpace(e.Body))
+}
+
+// Chat completions request and response types, limited to the fields used
+
+type openAIChatRequest struct {
+	Model         string               `json:"model"`
+	Messages      []openAIMessage      `json:"messages"`
+	Tools         []openAITool         `json:"tools,omitempty"`
+	MaxTokens     int64                `json:"max_tokens,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	Stop          []string             `json:"stop,omitempty"`
+	Stream        bool                 `json:"stream"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIMessage struct {
+	Role string `json:"role"`
+	// Content is a string, or a list of parts for messages with images
+	Content    any              `json:"content,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAITool struct {
+	Type     string             `json:"type"`
+	Function openAIToolFunction `json:"function"`
+}
+
+type openAIToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type openAIToolCall struct {
+	// Index identifies the call across stream chunks
+	Index    *int               `json:"index,omitempty"`
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type openAIChunk struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content   string           `json:"content"`
+			ToolCalls []openAIToolCall `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens        int64 `json:"prompt_tokens"`
+		CompletionTokens    int64 `json:"completion_tokens"`
+		PromptTokensDetails *struct {
+			CachedTokens int64 `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+func (p *OpenAIProvider) Stream(ctx context.Context, request InferenceRequest) EventStream {
+	chatRequest, err := newOpenAIChatRequest(request)
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+	body, err := json.Marshal(chatRequest)
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Accept", "text/event-stream")
+	if p.apiKey != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	response, err := p.httpClient.Do(httpRequest)
+	if err != nil {
+		return &openAIStream{err: err}
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+		return &openAIStream{err: &HTTPError{StatusCode: response.StatusCode, Body: string(body), Response: response}}
+	}
+	return &openAIStream{body: response.Body, reader: bufio.NewReader(response.Body)}
+}
+
+// newOpenAIChatRequest translates a request into the chat completions format
+func newOpenAIChatRequest(request InferenceRequest) (openAIChatRequest, error) {
+	chatRequest := openAIChatRequest{
+		Model:         request.Model,
+		MaxTokens:     request.MaxTokens,
+		Temperature:   request.Temperature,
+		Stop:          request.StopSequences,
+		Stream:        true,
+		StreamOptions: &openAIStreamOptions{IncludeUsage: true},
+	}
+
+	if request.System != "" {
+		chatRequest.Messages = append(chatRequest.Messages, openAIMessage{Role: "system", Content: request.System})
+	}
+	for _, message := range request.Messages {
+		messages, err := toOpenAIMessages(message)
+		if err != nil {
+			return chatRequest, err
+		}
+		chatRequest.Messages = append(chatRequest.Messages, messages...)
+	}
+
+	for _, tool := range request.Tools {
+		parameters, err := json.Marshal(tool.InputSchema)
+		if err != nil {
+			return chatRequest, fmt.Errorf("failed to encode schema of tool %s: %w", tool.Name, err)
+		}
+		chatRequest.Tools = append(chatRequest.Tools, openAITool{
+			Type: "function",
+			Function: openAIToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  parameters,
+			},
+		})
+	}
+	return chatRequest, nil
+}
+
+// toOpenAIMessages translates one message. Tool results become separate
+// "tool" messages, which have to directly follow the assistant message that
+// made the calls, so they come before any other content of the user message.
+// Thinking blocks are Anthropic specific and dropped.
+func toOpenAIMessages(message anthropic.MessageParam) ([]openAIMessage, error) {
+	messages := []openAIMessage{}
+	parts := []openAIContentPart{}
+	hasImage := false
+	var toolCalls []openAIToolCall
+
+	for _, block := range message.Content {
+		switch {
+		case block.OfRequestTextBlock != nil:
+			parts = append(parts, openAIContentPart{Type: "text", Text: block.OfRequestTextBlock.Text})
+		case block.OfRequestImageBlock != nil:
+			parts = append(parts, openAIImagePart(block.OfRequestImageBlock))
+			hasImage = true
+		case block.OfRequestToolUseBlock != nil:
+			arguments, err := json.Marshal(block.OfRequestToolUseBlock.Input)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode input of tool call %s: %w", block.OfRequestToolUseBlock.ID, err)
+			}
+			toolCalls = append(toolCalls, openAIToolCall{
+				ID:       block.OfRequestToolUseBlock.ID,
+				Type:     "function",
+				Function: openAIFunctionCall{Name: block.OfRequestToolUseBlock.Name, Arguments: string(arguments)},
+			})
+		case block.OfRequestToolResultBlock != nil:
+			result := block.OfRequestToolResultBlock
+			var text strings.Builder
+			for _, content := range result.Content {
+				if content.OfRequestTextBlock != nil {
+					text.WriteString(content.OfRequestTextBlock.Text)
+				}
+				// Tool messages can only hold text, so images move to
+				// the message that follows them
+				if content.OfRequestImageBlock != nil {
+					parts = append(parts, openAIImagePart(content.OfRequestImageBlock))
+					hasImage = true
+				}
+			}
+			content := text.String()
+			if result.IsError.Value {
+				content = "Error: " + content
+			}
+			messages = append(messages, openAIMessage{Role: "tool", ToolCallID: result.ToolUseID, Content: content})
+		}
+	}
+
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return messages, nil
+	}
+	translated := openAIMessage{Role: string(message.Role), ToolCalls: toolCalls}
+	if hasImage {
+		translated.Content = parts
+	} else if len(parts) > 0 {
+		var text strings.Builder
+		for _, part := range parts {
+			text.WriteString(part.Text)
+		}
+		translated.Content = text.String()
+	}
+	return append(messages, translated), nil
+}
+
+// openAIImagePart translates an image block into a content part
+func openAIImagePart(image *anthropic.ImageBlockParam) openAIContentPart {
+	url := ""
+	switch {
+	case image.Source.OfBase64ImageSource != nil:
+		url = fmt.Sprintf("data:%s;base64,%s", image.Source.OfBase64ImageSource.MediaType, image.Source.OfBase64ImageSource.Data)
+	case image.Source.OfURLImageSource != nil:
+		url = image.Source.OfURLImageSource.URL
+	}
+	return openAIContentPart{Type: "image_url", ImageURL: &openAIImageURL{URL: url}}
+}
+
+// openAIStream translates a chat completions stream into Anthropic streaming
+// events, so responses are accumulated and rendered the same way.
+type openAIStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	err    error
+
+	pending []anthropic.MessageStreamEventUnion
+	current anthropic.MessageStreamEventUnion
+
+	started    bool
+	done       bool
+	blockType  string
+	blocks     int
+	toolIndex  int
+	stopReason string
+	usage      map[string]int64
+}
+
+func (s *openAIStream) Next() bool {
+	for len(s.pending) == 0 {
+		if s.err != nil || s.done {
+			return false
+		}
+		s.readChunk()
+	}
+	s.current, s.pending = s.pending[0], s.pending[1:]
+	return true
+}
+
+func (s *openAIStream) Current() anthropic.MessageStreamEventUnion { return s.current }
+func (s *openAIStream) Err() error                                 { return s.err }
+
+func (s *openAIStream) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	return s.body.Close()
+}
+
+// readChunk reads the next server-sent event and queues the events it
+// translates to
+func (s *openAIStream) readChunk() {
+	line, err := s.reader.ReadString('\n')
+	if err != nil && line == "" {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		s.err = err
+		return
+	}
+	data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+	if !ok {
+		return
+	}
+	data = strings.TrimSpace(data)
+	if data == "[DONE]" {
+		s.finish()
+		return
+	}
+
+	var chunk openAIChunk
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		s.err = fmt.Errorf("failed to parse stream chunk: %w", err)
+		return
+	}
+	if chunk.Error != nil {
+		s.err = fmt.Errorf("received error while streaming: %s: %s", chunk.Error.Type, chunk.Error.Message)
+		return
+	}
+
+	if !s.started {
+		s.started = true
+		s.emit(map[string]any{
+			"type": "message_start",
+			"message": map[string]any{
+				"id": chunk.ID, "type": "message", "role": "assistant", "model": chunk.Model,
+				"content": []any{}, "stop_reason": nil,
+				"usage": map[string]any{"input_tokens": 0, "output_tokens": 0},
+			},
+		})
+	}
+
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" {
+			if s.blockType != "text" {
+				s.startBlock("text", map[string]any{"type": "text", "text": ""})
+			}
+			s.emit(map[string]any{
+				"type": "content_block_delta", "index": s.blocks - 1,
+				"delta": map[string]any{"type": "text_delta", "text": choice.Delta.Content},
+			})
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			index := 0
+			if call.Index != nil {
+				index = *call.Index
+			}
+			if s.blockType != "tool_use" || index != s.toolIndex {
+				s.toolIndex = index
+				s.startBlock("tool_use", map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]any{}})
+			}
+			if call.Function.Arguments != "" {
+				s.emit(map[string]any{
+					"type": "content_block_delta", "index": s.blocks - 1,
+					"delta": map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+				})
+			}
+		}
+		if choice.FinishReason != nil {
+			switch *choice.FinishReason {
+			case "length":
+				s.stopReason = string(anthropic.MessageStopReasonMaxTokens)
+			case "tool_calls", "function_call":
+				s.stopReason = string(anthropic.MessageStopReasonToolUse)
+			default:
+				s.stopReason = string(anthropic.MessageStopReasonEndTurn)
+			}
+		}
+	}
+
+	if chunk.Usage != nil {
+		cached := int64(0)
+		if chunk.Usage.PromptTokensDetails != nil {
+			cached = chunk.Usage.PromptTokensDetails.CachedTokens
+		}
+		s.usage = map[string]int64{
+			"input_tokens":            chunk.Usage.PromptTokens - cached,
+			"cache_read_input_tokens": cached,
+			"output_tokens":           chunk.Usage.CompletionTokens,
+		}
+	}
+}
+
+// startBlock closes the open content block and starts a new one
+func (s *openAIStream) startBlock(blockType string, block map[string]any) {
+	s.stopBlock()
+	s.blockType = blockType
+	s.emit(map[string]any{"type": "content_block_start", "index": s.blocks, "content_block": block})
+	s.blocks++
+}
+
+func (s *openAIStream) stopBlock() {
+	if s.blockType == "" {
+		return
+	}
+	s.emit(map[string]any{"type": "content_block_stop", "index": s.blocks - 1})
+	s.blockType = ""
+}
+
+// finish ends the message once the server is done
+func (s *openAIStream) finish() {
+	s.done = true
+	if !s.started {
+		s.err = fmt.Errorf("stream ended without a response")
+		return
+	}
+	s.stopBlock()
+	if s.stopReason == "" {
+		s.stopReason = string(anthropic.MessageStopReasonEndTurn)
+	}
+	usage := s.usage
+	if usage == nil {
+		usage = map[string]int64{"output_tokens": 0}
+	}
+	s.emit(map[string]any{"type": "message_delta", "delta": map[string]any{"stop_reason": s.stopReason}, "usage": usage})
+	s.emit(map[string]any{"type": "message_stop"})
+}
+
+// emit queues an event, built the way the Anthropic API would send it
+func (s *openAIStream) emit(event map[string]any) {
+	data, err := json.Marshal(event)
+	if err == nil {
+		var union anthropic.MessageStreamEventUnion
+		if err = union.UnmarshalJSON(data); err == nil {
+			s.pending = append(s.pending, union)
+			return
+		}
+	}
+	s.err = fmt.Errorf("failed to translate stream event: %w", err)
+}
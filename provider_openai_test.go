@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// openAIStandIn serves each request with the given server-sent event chunks
+// and records the request bodies.
+func openAIStandIn(t *testing.T, chunks []string, requests *[]map[string]any) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var request map[string]any
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		*requests = append(*requests, request)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenAIProviderTranslatesRequest(t *testing.T) {
+	var requests []map[string]any
+	server := openAIStandIn(t, []string{`{"id":"c1","model":"m","choices":[{"delta":{"content":"ok"},"finish_reason":"stop"}]}`}, &requests)
+
+	conversation := []anthropic.MessageParam{
+		anthropic.NewUserMessage(anthropic.NewTextBlock("Read main.go")),
+		anthropic.NewAssistantMessage(
+			anthropic.NewTextBlock("Reading it."),
+			anthropic.ContentBlockParamUnion{OfRequestToolUseBlock: &anthropic.ToolUseBlockParam{
+				ID: "call_1", Name: "read_file", Input: json.RawMessage(`{"path":"main.go"}`),
+			}},
+		),
+		anthropic.NewUserMessage(
+			anthropic.NewToolResultBlock("call_1", "package main", false),
+			anthropic.NewTextBlock("Now summarize it"),
+		),
+	}
+	provider := NewOpenAIProvider(server.URL+"/v1", "")
+	_, err := accumulateStream(provider.Stream(context.Background(), InferenceRequest{
+		Model:     "local-model",
+		MaxTokens: 100,
+		System:    "Be brief",
+		Messages:  conversation,
+		Tools:     []ToolDefinition{ReadFileDefinition},
+	}), nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	got, _ := json.Marshal(requests[0]["messages"])
+	want := `[{"content":"Be brief","role":"system"},` +
+		`{"content":"Read main.go","role":"user"},` +
+		`{"content":"Reading it.","role":"assistant","tool_calls":[{"function":{"arguments":"{\"path\":\"main.go\"}","name":"read_file"},"id":"call_1","type":"function"}]},` +
+		`{"content":"package main","role":"tool","tool_call_id":"call_1"},` +
+		`{"content":"Now summarize it","role":"user"}]`
+	if string(got) != want {
+		t.Errorf("messages:\n got %s\nwant %s", got, want)
+	}
+
+	tools := requests[0]["tools"].([]any)
+	function := tools[0].(map[string]any)["function"].(map[string]any)
+	parameters := function["parameters"].(map[string]any)
+	if function["name"] != "read_file" || parameters["type"] != "object" || parameters["properties"].(map[string]any)["path"] == nil {
+		t.Errorf("tool not translated: %v", function)
+	}
+}
+
+func TestOpenAIProviderStreamsToolCalls(t *testing.T) {
+	var requests []map[string]any
+	server := openAIStandIn(t, []string{
+		`{"id":"c1","model":"m","choices":[{"delta":{"role":"assistant","content":"Let me "}}]}`,
+		`{"id":"c1","model":"m","choices":[{"delta":{"content":"check."}}]}`,
+		`{"id":"c1","model":"m","choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"read_file","arguments":""}}]}}]}`,
+		`{"id":"c1","model":"m","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":"}}]}}]}`,
+		`{"id":"c1","model":"m","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"a.go\"}"}}]}}]}`,
+		`{"id":"c1","model":"m","choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"list_files","arguments":"{}"}}]}}]}`,
+		`{"id":"c1","model":"m","choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+		`{"id":"c1","model":"m","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":30,"prompt_tokens_details":{"cached_tokens":100}}}`,
+	}, &requests)
+
+	provider := NewOpenAIProvider(server.URL+"/v1", "")
+	message, err := accumulateStream(provider.Stream(context.Background(), InferenceRequest{Model: "local-model"}), nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	if message.StopReason != anthropic.MessageStopReasonToolUse {
+		t.Errorf("stop reason = %q, want tool_use", message.StopReason)
+	}
+	if message.Usage.InputTokens != 20 || message.Usage.CacheReadInputTokens != 100 || message.Usage.OutputTokens != 30 {
+		t.Errorf("usage = %+v", message.Usage)
+	}
+
+	response := message.ToParam()
+	if len(response.Content) != 3 {
+		t.Fatalf("got %d content blocks, want 3", len(response.Content))
+	}
+	if text := response.Content[0].OfRequestTextBlock; text == nil || text.Text != "Let me check." {
+		t.Errorf("text block = %+v", response.Content[0])
+	}
+	for i, want := range []struct{ id, name, input string }{
+		{"call_1", "read_file", `{"path":"a.go"}`},
+		{"call_2", "list_files", `{}`},
+	} {
+		toolUse := response.Content[i+1].OfRequestToolUseBlock
+		if toolUse == nil {
+			t.Fatalf("block %d is not a tool call", i+1)
+		}
+		input, _ := json.Marshal(toolUse.Input)
+		if toolUse.ID != want.id || toolUse.Name != want.name || string(input) != want.input {
+			t.Errorf("tool call %d = %s %s %s, want %s %s %s", i, toolUse.ID, toolUse.Name, input, want.id, want.name, want.input)
+		}
+	}
+}
+
+func TestOpenAIProviderReportsHTTPErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"slow down"}}`)
+	}))
+	defer server.Close()
+
+	provider := NewOpenAIProvider(server.URL, "")
+	_, err := accumulateStream(provider.Stream(context.Background(), InferenceRequest{Model: "local-model"}), nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	retryable, delay := classifyError(err)
+	if !retryable || delay != 2*time.Second {
+		t.Errorf("classifyError = %v, %v; want retryable after 2s", retryable, delay)
+	}
+}
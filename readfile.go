@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Lines returned by read_file when no limit is given
+	defaultReadLimit = 2000
+	// Most bytes of file content a single read_file call returns
+	maxReadBytes = 100 * 1024
+)
+
+// fileExcerpt is the range of lines of a text file returned by read_file
+type fileExcerpt struct {
+	Text string
+	// FirstLine and LastLine are the 1-based numbers of the lines returned
+	FirstLine int
+	LastLine  int
+	// TotalLines counts every line of the file
+	TotalLines int
+	// CappedBytes is set when fewer lines than requested were returned to
+	// stay within maxBytes
+	CappedBytes bool
+	// CutLine is set when a single line was longer than maxBytes and only
+	// its beginning was returned
+	CutLine bool
+}
+
+// readLines collects up to limit lines of r, starting at the 1-based line
+// offset, while keeping the text within maxBytes. The rest of r is still
+// read to count its lines. Numbered output prefixes every line with its
+// number, like cat -n.
+func readLines(r io.Reader, offset, limit, maxBytes int, numbered bool) (fileExcerpt, error) {
+	excerpt := fileExcerpt{FirstLine: offset}
+	var text strings.Builder
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			excerpt.TotalLines++
+			number := excerpt.TotalLines
+			wanted := number >= offset && number < offset+limit && !excerpt.CappedBytes && !excerpt.CutLine
+			if wanted {
+				if numbered {
+					line = fmt.Sprintf("%6d\t%s\n", number, strings.TrimRight(line, "\r\n"))
+				}
+				switch {
+				case text.Len()+len(line) <= maxBytes:
+					text.WriteString(line)
+					excerpt.LastLine = number
+				case text.Len() == 0:
+					// Return the beginning of a line too long to fit
+					text.WriteString(truncateUTF8(line, maxBytes))
+					excerpt.LastLine = number
+					excerpt.CutLine = true
+				default:
+					excerpt.CappedBytes = true
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return excerpt, err
+		}
+	}
+	excerpt.Text = text.String()
+	return excerpt, nil
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// notice explains which part of the file the excerpt holds when it isn't
+// the whole file, so the model knows how to read on
+func (e fileExcerpt) notice() string {
+	if e.CutLine {
+		return fmt.Sprintf("[Line %d of %d is longer than %d bytes and was cut off. The file can't be read in full with read_file; try grep or execute instead.]",
+			e.LastLine, e.TotalLines, maxReadBytes)
+	}
+	if e.FirstLine <= 1 && e.LastLine == e.TotalLines {
+		return ""
+	}
+	notice := fmt.Sprintf("[Showing lines %d-%d of %d", e.FirstLine, e.LastLine, e.TotalLines)
+	if e.CappedBytes {
+		notice += fmt.Sprintf(", cut short to stay within %d bytes", maxReadBytes)
+	}
+	if e.LastLine < e.TotalLines {
+		notice += fmt.Sprintf(". Use offset %d to read on.]", e.LastLine+1)
+	} else {
+		notice += ".]"
+	}
+	return notice
+}
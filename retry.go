@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// Delay before the first retry, doubled on every further attempt
+	retryBaseDelay = time.Second
+	// Upper bound for a single backoff delay
+	retryMaxDelay = time.Minute
+)
+
+// Error types the API reports inside a stream that are worth retrying
+var retryableStreamErrors = []string{"overloaded_error", "rate_limit_error", "api_error"}
+
+// withRetry calls fn until it succeeds, fails with an error that isn't worth
+// retrying, or maxRetries retries have been used up. Between attempts it
+// counts down in the terminal.
+func withRetry[T any](ctx context.Context, out io.Writer, maxRetries int, fn func() (T, error)) (T, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := fn()
+		if err == nil {
+			return result, nil
+		}
+
+		retryable, retryAfter := classifyError(err)
+		if !retryable || attempt >= maxRetries || ctx.Err() != nil {
+			return result, err
+		}
+
+		// A server asking for a longer wait than a backoff ever takes is
+		// tried again after retryMaxDelay rather than stalling the session
+		delay := min(retryAfter, retryMaxDelay)
+		if delay <= 0 {
+			delay = backoffDelay(attempt)
+		}
+		if err := countdown(ctx, out, delay, fmt.Sprintf("%s (attempt %d/%d)", describeError(err), attempt+1, maxRetries)); err != nil {
+			return result, err
+		}
+	}
+}
+
+// classifyError reports whether err is transient and, if the server said so,
+// how long to wait before trying again.
+func classifyError(err error) (bool, time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+	var mismatch *CassetteMismatchError
+	if errors.As(err, &mismatch) {
+		return false, 0
+	}
+
+	if statusCode, response, ok := errorStatus(err); ok {
+		switch {
+		case statusCode == http.StatusTooManyRequests,
+			statusCode == http.StatusRequestTimeout,
+			statusCode >= 500:
+			return true, retryAfter(response)
+		default:
+			// 400 invalid request, 401 authentication and the like won't
+			// succeed on a second try
+			return false, 0
+		}
+	}
+
+	// Errors reported as an event in the middle of a stream
+	for _, errorType := range retryableStreamErrors {
+		if strings.Contains(err.Error(), errorType) {
+			return true, 0
+		}
+	}
+
+	// Dropped or reset connections
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) {
+		return true, 0
+	}
+
+	return false, 0
+}
+
+// errorStatus extracts the HTTP status of a failed request from the errors of
+// any provider
+func errorStatus(err error) (int, *http.Response, bool) {
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode, apiErr.Response, true
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode, httpErr.Response, true
+	}
+	return 0, nil, false
+}
+
+// retryAfter reads the delay requested by the retry-after-ms or retry-after
+// headers. The latter may hold either seconds or an HTTP date.
+func retryAfter(response *http.Response) time.Duration {
+	if response == nil {
+		return 0
+	}
+	if value := response.Header.Get("retry-after-ms"); value != "" {
+		if ms, err := strconv.ParseFloat(value, 64); err == nil && ms > 0 {
+			return time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	if value := response.Header.Get("retry-after"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return time.Until(date)
+		}
+	}
+	return 0
+}
+
+// backoffDelay is an exponential backoff with equal jitter: half of the delay
+// is fixed and the other half random, so retries are spread out but never
+// come sooner than half the backoff
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// describeError gives a short, human readable reason for a failed request
+func describeError(err error) string {
+	if statusCode, _, ok := errorStatus(err); ok {
+		switch statusCode {
+		case http.StatusTooManyRequests:
+			return "Rate limited (429)"
+		case 529:
+			return "API overloaded (529)"
+		}
+		return fmt.Sprintf("API error (%d)", statusCode)
+	}
+	if strings.Contains(err.Error(), "overloaded_error") {
+		return "API overloaded"
+	}
+	return "Request failed"
+}
+
+// countdown waits for delay while showing the seconds left on a single
+// terminal line. It returns early if the context is cancelled.
+func countdown(ctx context.Context, out io.Writer, delay time.Duration, reason string) error {
+	deadline := time.Now().Add(delay)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			fmt.Fprint(out, "\r\u001b[K")
+			return nil
+		}
+		fmt.Fprintf(out, "\r\u001b[K\u001b[96mretry\u001b[0m: %s, retrying in %ds", reason, int(remaining.Round(time.Second)/time.Second))
+
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(out)
+			return ctx.Err()
+		case <-ticker.C:
+		case <-time.After(remaining):
+		}
+	}
+}
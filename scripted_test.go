@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Turn is one scripted assistant response. The agent's request for it has to
+// carry the tool results listed in Expect.
+type Turn struct {
+	// Expect checks the tool results sent with the request, in order. A turn
+	// without expectations doesn't check them.
+	Expect []Result
+	Text   string
+	Calls  []Call
+}
+
+// Call is a tool call made by the scripted model
+type Call struct {
+	Tool string
+	// Input is encoded as JSON, except for a json.RawMessage which is sent
+	// as is
+	Input any
+}
+
+// Result is an expected tool result
+type Result struct {
+	// Contains is a substring of the result content
+	Contains string
+	IsError  bool
+	// Images is the number of images the result carries
+	Images int
+}
+
+// ScriptedProvider is a model backend that plays back a script of responses
+// and asserts on the tool results it's sent, so the agent loop and tools can
+// be tested without a network.
+type ScriptedProvider struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	turns    []Turn
+	next     int
+	requests []InferenceRequest
+}
+
+// NewScriptedProvider creates a provider playing back turns. The test fails
+// if the script isn't played to the end.
+func NewScriptedProvider(t *testing.T, turns ...Turn) *ScriptedProvider {
+	p := &ScriptedProvider{t: t, turns: turns}
+	t.Cleanup(func() {
+		if remaining := len(p.turns) - p.next; remaining > 0 && !t.Failed() {
+			t.Errorf("%d scripted turns were never requested", remaining)
+		}
+	})
+	return p
+}
+
+func (p *ScriptedProvider) Stream(ctx context.Context, request InferenceRequest) EventStream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, request)
+	if p.next >= len(p.turns) {
+		p.t.Errorf("unexpected request %d, the script has %d turns", p.next+1, len(p.turns))
+		return &scriptedStream{err: fmt.Errorf("script exhausted")}
+	}
+	turn := p.turns[p.next]
+	p.next++
+
+	if turn.Expect != nil {
+		p.checkResults(p.next, turn.Expect, request.Messages)
+	}
+	events, err := scriptedEvents(p.next, turn)
+	if err != nil {
+		p.t.Errorf("turn %d: %v", p.next, err)
+	}
+	return &scriptedStream{events: events, err: err}
+}
+
+// checkResults compares the tool results of the last message with the
+// expected ones
+func (p *ScriptedProvider) checkResults(turn int, expected []Result, messages []anthropic.MessageParam) {
+	p.t.Helper()
+	var results []*anthropic.ToolResultBlockParam
+	if len(messages) > 0 {
+		for _, block := range messages[len(messages)-1].Content {
+			if block.OfRequestToolResultBlock != nil {
+				results = append(results, block.OfRequestToolResultBlock)
+			}
+		}
+	}
+	if len(results) != len(expected) {
+		p.t.Errorf("turn %d: got %d tool results, want %d", turn, len(results), len(expected))
+		return
+	}
+	for i, want := range expected {
+		content := toolResultContent(results[i])
+		if results[i].IsError.Value != want.IsError {
+			p.t.Errorf("turn %d, result %d: is_error = %v, want %v (content %q)", turn, i+1, results[i].IsError.Value, want.IsError, content)
+		}
+		if !strings.Contains(content, want.Contains) {
+			p.t.Errorf("turn %d, result %d: content %q doesn't contain %q", turn, i+1, content, want.Contains)
+		}
+		images := 0
+		for _, block := range results[i].Content {
+			if block.OfRequestImageBlock != nil {
+				images++
+			}
+		}
+		if images != want.Images {
+			p.t.Errorf("turn %d, result %d: got %d images, want %d", turn, i+1, images, want.Images)
+		}
+	}
+}
+
+func toolResultContent(result *anthropic.ToolResultBlockParam) string {
+	var content strings.Builder
+	for _, block := range result.Content {
+		if block.OfRequestTextBlock != nil {
+			content.WriteString(block.OfRequestTextBlock.Text)
+		}
+	}
+	return content.String()
+}
+
+// scriptedEvents builds the stream events the API would send for a turn
+func scriptedEvents(number int, turn Turn) ([]anthropic.MessageStreamEventUnion, error) {
+	raw := []map[string]any{{
+		"type": "message_start",
+		"message": map[string]any{
+			"id": fmt.Sprintf("msg_scripted_%d", number), "type": "message", "role": "assistant",
+			"model": "scripted", "content": []any{}, "usage": map[string]any{"input_tokens": 0, "output_tokens": 0},
+		},
+	}}
+	index := 0
+	if turn.Text != "" {
+		raw = append(raw,
+			map[string]any{"type": "content_block_start", "index": index, "content_block": map[string]any{"type": "text", "text": ""}},
+			map[string]any{"type": "content_block_delta", "index": index, "delta": map[string]any{"type": "text_delta", "text": turn.Text}},
+			map[string]any{"type": "content_block_stop", "index": index},
+		)
+		index++
+	}
+	for i, call := range turn.Calls {
+		input, ok := call.Input.(json.RawMessage)
+		switch {
+		case call.Input == nil:
+			input = json.RawMessage("{}")
+		case !ok:
+			var err error
+			if input, err = json.Marshal(call.Input); err != nil {
+				return nil, fmt.Errorf("invalid input for %s: %w", call.Tool, err)
+			}
+		}
+		block := map[string]any{"type": "tool_use", "id": fmt.Sprintf("toolu_%d_%d", number, i+1), "name": call.Tool, "input": map[string]any{}}
+		raw = append(raw,
+			map[string]any{"type": "content_block_start", "index": index, "content_block": block},
+			map[string]any{"type": "content_block_delta", "index": index, "delta": map[string]any{"type": "input_json_delta", "partial_json": string(input)}},
+			map[string]any{"type": "content_block_stop", "index": index},
+		)
+		index++
+	}
+	stopReason := anthropic.MessageStopReasonEndTurn
+	if len(turn.Calls) > 0 {
+		stopReason = anthropic.MessageStopReasonToolUse
+	}
+	raw = append(raw,
+		map[string]any{"type": "message_delta", "delta": map[string]any{"stop_reason": stopReason}, "usage": map[string]any{"output_tokens": 0}},
+		map[string]any{"type": "message_stop"},
+	)
+
+	events := make([]anthropic.MessageStreamEventUnion, len(raw))
+	for i, event := range raw {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		if err := events[i].UnmarshalJSON(data); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// scriptedStream replays a fixed list of events
+type scriptedStream struct {
+	events  []anthropic.MessageStreamEventUnion
+	current anthropic.MessageStreamEventUnion
+	err     error
+}
+
+func (s *scriptedStream) Next() bool {
+	if s.err != nil || len(s.events) == 0 {
+		return false
+	}
+	s.current, s.events = s.events[0], s.events[1:]
+	return true
+}
+
+func (s *scriptedStream) Current() anthropic.MessageStreamEventUnion { return s.current }
+func (s *scriptedStream) Err() error                                 { return s.err }
+func (s *scriptedStream) Close() error                               { return nil }
+
+// useWorkspace runs the rest of the test in a temporary directory holding
+// files, keyed by their relative path
+func useWorkspace(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	return dir
+}
+
+// runScript sends prompt to an agent with the given tools, backed by a model
+// that plays turns, and returns the agent once the model is done
+func runScript(t *testing.T, tools []ToolDefinition, prompt string, turns ...Turn) *Agent {
+	t.Helper()
+	agent := newScriptedAgent(NewScriptedProvider(t, turns...), tools, prompt)
+	runAgent(t, agent)
+	return agent
+}
+
+// newScriptedAgent creates an agent with the given tools that sends prompt to
+// the provider and then stops
+func newScriptedAgent(provider Provider, tools []ToolDefinition, prompt string) *Agent {
+	asked := false
+	getUserMessage := func(string) (string, bool) {
+		if asked {
+			return "", false
+		}
+		asked = true
+		return prompt, true
+	}
+	agent := NewAgent(provider, getUserMessage, tools, DefaultConfig(), "")
+	agent.streamHandler = nil
+	return agent
+}
+
+// runAgent runs an agent created by newScriptedAgent
+func runAgent(t *testing.T, agent *Agent) {
+	t.Helper()
+	if err := agent.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+}
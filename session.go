@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Project-local directory that session transcripts are written to
+const sessionDir = ".agent/sessions"
+
+// sessionRecord is a single line of a session file. A "message" record holds
+// one anthropic.MessageParam; a "reset" record means the conversation was
+// rewritten (e.g. by compaction) and every earlier message should be dropped.
+type sessionRecord struct {
+	Type    string          `json:"type"`
+	Time    time.Time       `json:"time"`
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+// Session appends every message of a conversation to a JSONL file so that it
+// can be resumed after the process exits.
+type Session struct {
+	ID   string
+	Path string
+	file *os.File
+}
+
+// NewSession creates a new, empty session file in dir
+func NewSession(dir string) (*Session, error) {
+	// The random suffix keeps sessions started in the same second apart
+	id := fmt.Sprintf("%s-%04x", time.Now().Format("20060102-150405"), rand.Intn(0x10000))
+	return openSessionFile(dir, id)
+}
+
+// ResumeSession opens an existing session for appending and returns the
+// conversation recorded in it.
+func ResumeSession(out io.Writer, dir, id string) (*Session, []anthropic.MessageParam, error) {
+	path := filepath.Join(dir, id+".jsonl")
+	conversation, repaired, err := LoadSessionConversation(out, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := openSessionFile(dir, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Record the repaired conversation so the file matches what is resumed
+	if repaired {
+		if err := session.Reset(conversation); err != nil {
+			session.Close()
+			return nil, nil, err
+		}
+	}
+	return session, conversation, nil
+}
+
+// LatestSessionID returns the ID of the most recently modified session in dir
+func LatestSessionID(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("no sessions found in %s", dir)
+		}
+		return "", err
+	}
+
+	type candidate struct {
+		id      string
+		modTime time.Time
+	}
+	candidates := []candidate{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, candidate{strings.TrimSuffix(entry.Name(), ".jsonl"), info.ModTime()})
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no sessions found in %s", dir)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime.After(candidates[j].modTime)
+	})
+	return candidates[0].id, nil
+}
+
+func openSessionFile(dir, id string) (*Session, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+	path := filepath.Join(dir, id+".jsonl")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session file: %w", err)
+	}
+
+	// A crash mid-write can leave a partial last line; terminate it so new
+	// records don't get glued onto it
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			file.Write([]byte("\n"))
+		}
+	}
+
+	return &Session{ID: id, Path: path, file: file}, nil
+}
+
+// Append records messages that were added to the conversation
+func (s *Session) Append(messages ...anthropic.MessageParam) error {
+	for _, message := range messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+		if err := s.write(sessionRecord{Type: "message", Time: time.Now(), Message: data}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset records that the conversation was replaced wholesale
+func (s *Session) Reset(conversation []anthropic.MessageParam) error {
+	if err := s.write(sessionRecord{Type: "reset", Time: time.Now()}); err != nil {
+		return err
+	}
+	return s.Append(conversation...)
+}
+
+func (s *Session) write(record sessionRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode session record: %w", err)
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	return nil
+}
+
+// Close closes the underlying session file
+func (s *Session) Close() error {
+	return s.file.Close()
+}
+
+// LoadSessionConversation rebuilds a conversation from a session file.
+// Lines that can't be parsed (e.g. a write cut short by a crash) are skipped
+// with a warning, together with the rest of the turn they belong to, and the
+// result is trimmed so it ends in a consistent state. It also reports whether
+// anything was dropped, i.e. whether the file needs the repair recorded.
+func LoadSessionConversation(out io.Writer, path string) ([]anthropic.MessageParam, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open session file: %w", err)
+	}
+	defer file.Close()
+
+	conversation := []anthropic.MessageParam{}
+	// Whether a record of the current turn was lost. Its other messages are
+	// dropped until the next turn starts, since a tool_use without its
+	// tool_result, or the other way around, would be rejected by the API.
+	damaged := false
+	// Whether anything since the last reset was dropped
+	repaired := false
+	skip := func(format string, args ...any) {
+		fmt.Fprintf(out, "Warning: "+format+"; dropping the rest of its turn\n", args...)
+		conversation = trimIncompleteTurn(conversation)
+		damaged, repaired = true, true
+	}
+	reader := bufio.NewReader(file)
+	lineNum := 0
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			lineNum++
+			var record sessionRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				skip("Skipping corrupted line %d in %s: %v", lineNum, path, err)
+			} else {
+				switch record.Type {
+				case "reset":
+					conversation = []anthropic.MessageParam{}
+					damaged, repaired = false, false
+				case "message":
+					message, err := decodeMessageParam(record.Message)
+					switch {
+					case err != nil:
+						skip("Skipping unreadable message on line %d in %s: %v", lineNum, path, err)
+					case damaged && !isTurnStart(message):
+					default:
+						conversation = append(conversation, message)
+						damaged = false
+					}
+				}
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	trimmed := trimIncompleteTurn(conversation)
+	return trimmed, repaired || len(trimmed) != len(conversation), nil
+}
+
+// trimIncompleteTurn drops trailing messages until the conversation ends with
+// a finished assistant reply, so a resumed session never starts with an
+// unanswered tool_use or a dangling user message.
+func trimIncompleteTurn(conversation []anthropic.MessageParam) []anthropic.MessageParam {
+	for len(conversation) > 0 {
+		last := conversation[len(conversation)-1]
+		if last.Role == anthropic.MessageParamRoleAssistant && !hasToolUse(last) {
+			break
+		}
+		conversation = conversation[:len(conversation)-1]
+	}
+	return conversation
+}
+
+func hasToolUse(message anthropic.MessageParam) bool {
+	for _, block := range message.Content {
+		if block.OfRequestToolUseBlock != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// storedContentBlock mirrors the JSON shape of every content block type we
+// write, since the SDK's param unions can only be marshalled, not unmarshalled.
+type storedContentBlock struct {
+	Type      string               `json:"type"`
+	Text      string               `json:"text,omitempty"`
+	ID        string               `json:"id,omitempty"`
+	Name      string               `json:"name,omitempty"`
+	Input     json.RawMessage      `json:"input,omitempty"`
+	ToolUseID string               `json:"tool_use_id,omitempty"`
+	IsError   bool                 `json:"is_error,omitempty"`
+	Content   []storedContentBlock `json:"content,omitempty"`
+	Thinking  string               `json:"thinking,omitempty"`
+	Signature string               `json:"signature,omitempty"`
+	Data      string               `json:"data,omitempty"`
+	Source    *struct {
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+	} `json:"source,omitempty"`
+}
+
+type storedMessage struct {
+	Role    string               `json:"role"`
+	Content []storedContentBlock `json:"content"`
+}
+
+// decodeMessageParam parses a JSON encoded anthropic.MessageParam
+func decodeMessageParam(data []byte) (anthropic.MessageParam, error) {
+	var stored storedMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return anthropic.MessageParam{}, err
+	}
+
+	var blocks []anthropic.ContentBlockParamUnion
+	for _, block := range stored.Content {
+		param, err := block.toParam()
+		if err != nil {
+			return anthropic.MessageParam{}, err
+		}
+		blocks = append(blocks, param)
+	}
+
+	switch stored.Role {
+	case "user":
+		return anthropic.NewUserMessage(blocks...), nil
+	case "assistant":
+		return anthropic.NewAssistantMessage(blocks...), nil
+	}
+	return anthropic.MessageParam{}, fmt.Errorf("unknown message role %q", stored.Role)
+}
+
+func (b storedContentBlock) toParam() (anthropic.ContentBlockParamUnion, error) {
+	switch b.Type {
+	case "text":
+		return anthropic.NewTextBlock(b.Text), nil
+	case "image":
+		if b.Source == nil {
+			return anthropic.ContentBlockParamUnion{}, fmt.Errorf("image block has no source")
+		}
+		return anthropic.NewImageBlockBase64(b.Source.MediaType, b.Source.Data), nil
+	case "tool_use":
+		input := b.Input
+		if len(input) == 0 {
+			input = json.RawMessage("{}")
+		}
+		return anthropic.ContentBlockParamUnion{OfRequestToolUseBlock: &anthropic.ToolUseBlockParam{
+			ID:    b.ID,
+			Name:  b.Name,
+			Input: input,
+		}}, nil
+	case "tool_result":
+		result := anthropic.ToolResultBlockParam{ToolUseID: b.ToolUseID}
+		if b.IsError {
+			result.IsError = anthropic.Bool(true)
+		}
+		for _, content := range b.Content {
+			param, err := content.toParam()
+			if err != nil {
+				return anthropic.ContentBlockParamUnion{}, err
+			}
+			switch {
+			case param.OfRequestTextBlock != nil:
+				result.Content = append(result.Content, anthropic.ToolResultBlockParamContentUnion{OfRequestTextBlock: param.OfRequestTextBlock})
+			case param.OfRequestImageBlock != nil:
+				result.Content = append(result.Content, anthropic.ToolResultBlockParamContentUnion{OfRequestImageBlock: param.OfRequestImageBlock})
+			}
+		}
+		return anthropic.ContentBlockParamUnion{OfRequestToolResultBlock: &result}, nil
+	case "thinking":
+		return anthropic.ContentBlockParamUnion{OfRequestThinkingBlock: &anthropic.ThinkingBlockParam{
+			Thinking:  b.Thinking,
+			Signature: b.Signature,
+		}}, nil
+	case "redacted_thinking":
+		return anthropic.ContentBlockParamUnion{OfRequestRedactedThinkingBlock: &anthropic.RedactedThinkingBlockParam{
+			Data: b.Data,
+		}}, nil
+	}
+	return anthropic.ContentBlockParamUnion{}, fmt.Errorf("unknown content block type %q", b.Type)
+}
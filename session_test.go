@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// describeMessages summarizes a conversation as one short string per message
+func describeMessages(conversation []anthropic.MessageParam) []string {
+	descriptions := []string{}
+	for _, message := range conversation {
+		block := message.Content[0]
+		switch {
+		case block.OfRequestTextBlock != nil:
+			descriptions = append(descriptions, string(message.Role)+": "+block.OfRequestTextBlock.Text)
+		case block.OfRequestToolUseBlock != nil:
+			descriptions = append(descriptions, "tool_use "+block.OfRequestToolUseBlock.ID)
+		case block.OfRequestToolResultBlock != nil:
+			descriptions = append(descriptions, "tool_result "+block.OfRequestToolResultBlock.ToolUseID)
+		}
+	}
+	return descriptions
+}
+
+func TestLoadSessionSkipsDamagedTurns(t *testing.T) {
+	const unreadable = `{"type":"message","message":{"role":"user","content":[{"type":"hologram"}]}}` + "\n"
+	const corrupted = `{"type":"message","mess` + "\n"
+
+	tests := []struct {
+		name     string
+		records  []any
+		want     []string
+		repaired bool
+	}{
+		{
+			name: "intact",
+			records: []any{
+				userText("first"), toolUse("a"), toolResult("a"), assistantText("one"),
+			},
+			want: []string{"user: first", "tool_use a", "tool_result a", "assistant: one"},
+		},
+		{
+			name: "unreadable tool result",
+			records: []any{
+				userText("first"), assistantText("one"),
+				userText("second"), toolUse("a"), unreadable, assistantText("two"),
+				userText("third"), assistantText("three"),
+			},
+			want:     []string{"user: first", "assistant: one", "user: third", "assistant: three"},
+			repaired: true,
+		},
+		{
+			name: "unreadable tool use",
+			records: []any{
+				userText("first"), toolUse("a"), toolResult("a"), unreadable, toolResult("b"), assistantText("one"),
+				userText("second"), assistantText("two"),
+			},
+			want:     []string{"user: second", "assistant: two"},
+			repaired: true,
+		},
+		{
+			name: "unreadable prompt",
+			records: []any{
+				userText("first"), assistantText("one"),
+				unreadable, toolUse("a"), toolResult("a"), assistantText("two"),
+			},
+			want:     []string{"user: first", "assistant: one"},
+			repaired: true,
+		},
+		{
+			name: "line cut short",
+			records: []any{
+				userText("first"), assistantText("one"),
+				userText("second"), corrupted,
+			},
+			want:     []string{"user: first", "assistant: one"},
+			repaired: true,
+		},
+		{
+			name: "unanswered tool call",
+			records: []any{
+				userText("first"), assistantText("one"),
+				userText("second"), toolUse("a"),
+			},
+			want:     []string{"user: first", "assistant: one"},
+			repaired: true,
+		},
+		{
+			name: "reset after the damage",
+			records: []any{
+				userText("first"), toolUse("a"), unreadable,
+				sessionRecord{Type: "reset"}, userText("second"), assistantText("two"),
+			},
+			want: []string{"user: second", "assistant: two"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, err := NewSession(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, record := range test.records {
+				switch record := record.(type) {
+				case anthropic.MessageParam:
+					err = session.Append(record)
+				case sessionRecord:
+					err = session.write(record)
+				case string:
+					_, err = session.file.WriteString(record)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			session.Close()
+
+			conversation, repaired, err := LoadSessionConversation(io.Discard, session.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describeMessages(conversation); !slices.Equal(got, test.want) {
+				t.Errorf("loaded conversation = %q, want %q", got, test.want)
+			}
+			if repaired != test.repaired {
+				t.Errorf("repaired = %v, want %v", repaired, test.repaired)
+			}
+		})
+	}
+}
+
+func TestResumeSessionRecordsRepairsOnly(t *testing.T) {
+	dir := t.TempDir()
+	session, err := NewSession(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Append(userText("first"), assistantText("one")); err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	resets := func() int {
+		data, err := os.ReadFile(session.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), `"type":"reset"`)
+	}
+	resume := func(messages ...anthropic.MessageParam) {
+		resumed, _, err := ResumeSession(io.Discard, dir, session.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resumed.Append(messages...); err != nil {
+			t.Fatal(err)
+		}
+		resumed.Close()
+	}
+
+	// An intact session is appended to as it is
+	resume(userText("second"), toolUse("a"))
+	if got := resets(); got != 0 {
+		t.Errorf("session file has %d resets after resuming an intact session, want 0", got)
+	}
+
+	// The unanswered tool call is dropped, which the file has to record once
+	resume(userText("third"), assistantText("three"))
+	resume()
+	if got := resets(); got != 1 {
+		t.Errorf("session file has %d resets after resuming a repaired session, want 1", got)
+	}
+
+	conversation, repaired, err := LoadSessionConversation(io.Discard, session.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user: first", "assistant: one", "user: third", "assistant: three"}
+	if got := describeMessages(conversation); !slices.Equal(got, want) || repaired {
+		t.Errorf("loaded conversation = %q (repaired %v), want %q", got, repaired, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// StreamHandler is called for every event of a streaming response, after the
+// event has been folded into the partially accumulated message.
+type StreamHandler func(event anthropic.MessageStreamEventUnion, message *anthropic.Message)
+
+// accumulateStream drains a message stream into a single anthropic.Message,
+// handing each event to the handler as it arrives. Every code path that talks
+// to the model goes through here so the final message is built the same way.
+func accumulateStream(stream EventStream, handler StreamHandler) (*anthropic.Message, error) {
+	defer stream.Close()
+
+	message := anthropic.Message{}
+	for stream.Next() {
+		event := stream.Current()
+		// A response cut off by max_tokens can end a tool_use block with
+		// incomplete input JSON, which the SDK refuses to accumulate. Blank
+		// it out; callers spot the truncation from the stop reason.
+		if event.Type == "content_block_stop" && len(message.Content) > 0 {
+			last := &message.Content[len(message.Content)-1]
+			if last.Type == "tool_use" && !json.Valid(last.Input) {
+				last.Input = json.RawMessage("{}")
+			}
+		}
+		if err := message.Accumulate(event); err != nil {
+			return nil, fmt.Errorf("failed to accumulate stream: %w", err)
+		}
+		if event.Type == "message_delta" {
+			accumulateInputUsage(event, &message)
+		}
+		if handler != nil {
+			handler(event, &message)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// accumulateInputUsage picks up input token counts from a message_delta
+// event. The SDK only takes output tokens from it, but providers that learn
+// the prompt size at the end of the response report it there.
+func accumulateInputUsage(event anthropic.MessageStreamEventUnion, message *anthropic.Message) {
+	var delta struct {
+		Usage struct {
+			InputTokens              *int64 `json:"input_tokens"`
+			CacheCreationInputTokens *int64 `json:"cache_creation_input_tokens"`
+			CacheReadInputTokens     *int64 `json:"cache_read_input_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(event.RawJSON()), &delta); err != nil {
+		return
+	}
+	if delta.Usage.InputTokens != nil {
+		message.Usage.InputTokens = *delta.Usage.InputTokens
+	}
+	if delta.Usage.CacheCreationInputTokens != nil {
+		message.Usage.CacheCreationInputTokens = *delta.Usage.CacheCreationInputTokens
+	}
+	if delta.Usage.CacheReadInputTokens != nil {
+		message.Usage.CacheReadInputTokens = *delta.Usage.CacheReadInputTokens
+	}
+}
+
+// continuationHandler passes the events of a response that continues a
+// prefilled one on to handler, except for the start of the first text block.
+// Its text carries on from the prefill, which was shown with its prefix.
+func continuationHandler(handler StreamHandler) StreamHandler {
+	if handler == nil {
+		return nil
+	}
+	started := false
+	return func(event anthropic.MessageStreamEventUnion, message *anthropic.Message) {
+		if !started && event.Type == "content_block_start" && event.ContentBlock.Type == "text" {
+			started = true
+			return
+		}
+		handler(event, message)
+	}
+}
+
+// printStreamEvent renders a streaming response to out: text is
+// printed as it arrives, thinking is dimmed and tool calls are announced as
+// soon as they start.
+func printStreamEvent(out io.Writer, event anthropic.MessageStreamEventUnion, message *anthropic.Message) {
+	switch event.Type {
+	case "content_block_start":
+		switch event.ContentBlock.Type {
+		case "text":
+			fmt.Fprint(out, "\u001b[93mClaude\u001b[0m: ")
+		case "thinking":
+			fmt.Fprint(out, "\u001b[90mthinking: ")
+		case "redacted_thinking":
+			fmt.Fprint(out, "\u001b[90mthinking: [redacted]")
+		case "tool_use":
+			fmt.Fprintf(out, "\u001b[92mtool\u001b[0m: %s", event.ContentBlock.Name)
+		}
+	case "content_block_delta":
+		switch event.Delta.Type {
+		case "text_delta":
+			fmt.Fprint(out, event.Delta.Text)
+		case "thinking_delta":
+			fmt.Fprint(out, event.Delta.Thinking)
+		}
+	case "content_block_stop":
+		if len(message.Content) == 0 {
+			return
+		}
+		// The block is complete, so a tool call's input is now known
+		content := message.Content[len(message.Content)-1]
+		switch content.Type {
+		case "text":
+			fmt.Fprintln(out)
+		case "thinking", "redacted_thinking":
+			fmt.Fprintln(out, "\u001b[0m")
+		case "tool_use":
+			fmt.Fprintf(out, "(%s)\n", content.Input)
+		}
+	}
+}
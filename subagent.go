@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Name of the tool that starts a sub-agent
+const taskToolName = "task"
+
+const taskPrompt = `You are a sub-agent of a coding agent. You have been given a single task to carry out on your own: nobody will answer questions, and your tools can only read, not modify.
+
+- Investigate as thoroughly as the task needs, then stop.
+- Your final response is all the main agent will see of your work. Make it a complete, self-contained summary with the findings, the relevant file paths and line numbers, and anything you couldn't determine.
+- Quote tool output only where it is essential.`
+
+// Sent to a sub-agent that has run out of turns or tokens
+const taskLimitPrompt = "You have reached the %s limit of this task. Don't call any more tools; reply with a summary of what you found so far and what is left undone."
+
+type TaskInput struct {
+	Description string   `json:"description" jsonschema_description:"A short (3-5 word) description of the task, shown to the user"`
+	Prompt      string   `json:"prompt" jsonschema_description:"The task for the sub-agent. It can't see this conversation, so include all the context it needs and say what its summary should contain."`
+	Tools       []string `json:"tools,omitempty" jsonschema_description:"Optional names of the tools the sub-agent may use. Defaults to all read-only tools."`
+}
+
+var TaskInputSchema = GenerateSchema[TaskInput]()
+
+// taskCounter numbers sub-agents so that concurrent ones can be told apart
+var taskCounter atomic.Int64
+
+// outputMu keeps the lines of concurrent sub-agents from interleaving
+var outputMu sync.Mutex
+
+// EnableTasks offers the model the task tool, so that it can delegate work
+// to sub-agents
+func (a *Agent) EnableTasks() {
+	a.tools = append(a.tools, ToolDefinition{
+		Name: taskToolName,
+		Description: `Start a sub-agent to carry out a self-contained task, such as finding every caller of a function and summarizing how it is used.
+
+The sub-agent has its own conversation and read-only tools, and only its final summary is returned, which keeps bulky search and file output out of this conversation. Several tasks can run at the same time.`,
+		InputSchema: TaskInputSchema,
+		Function:    a.runTask,
+		Concurrency: ConcurrencyReadOnly,
+	})
+}
+
+// runTask executes the task tool: it runs a nested agent on the prompt and
+// returns the agent's final response
+func (a *Agent) runTask(ctx context.Context, input json.RawMessage) (string, error) {
+	taskInput := TaskInput{}
+	if err := json.Unmarshal(input, &taskInput); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(taskInput.Prompt) == "" {
+		return "", fmt.Errorf("prompt cannot be empty")
+	}
+	tools, err := a.taskTools(taskInput.Tools)
+	if err != nil {
+		return "", err
+	}
+
+	label := fmt.Sprintf("task %d", taskCounter.Add(1))
+	if taskInput.Description != "" {
+		label += ": " + taskInput.Description
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	sub := NewAgent(a.provider, nil, tools, a.config, taskPrompt+"\n\n"+environmentInfo(workingDir))
+	sub.compaction = a.compaction
+	sub.usage = a.usage.NewChild("task")
+	// Progress is only shown where the parent's is
+	sub.streamHandler = nil
+	if a.streamHandler != nil {
+		sub.streamHandler = nestedStreamHandler(a.out, label)
+		printNested(a.out, label, "Started")
+	}
+
+	summary, turns, err := sub.completeTask(ctx, taskInput.Prompt)
+	if a.streamHandler != nil {
+		status := "Finished"
+		if err != nil {
+			status = "Failed: " + err.Error()
+		}
+		printNested(a.out, label, fmt.Sprintf("%s after %d turns and %s tokens", status, turns, formatTokens(sub.usage.SessionUsage().Total())))
+	}
+	if err != nil {
+		return "", fmt.Errorf("task failed: %w", err)
+	}
+	if summary == "" {
+		return "The task finished without a summary.", nil
+	}
+	return summary, nil
+}
+
+// taskTools picks the tools of a sub-agent: the read-only tools of a,
+// narrowed down to the given names if there are any. Sub-agents can't start
+// sub-agents of their own.
+func (a *Agent) taskTools(names []string) ([]ToolDefinition, error) {
+	available := []ToolDefinition{}
+	availableNames := []string{}
+	for _, tool := range a.tools {
+		if tool.Name == taskToolName {
+			continue
+		}
+		if isReadOnlyTool(tool) {
+			available = append(available, tool)
+			availableNames = append(availableNames, tool.Name)
+		}
+	}
+	if len(names) == 0 {
+		return available, nil
+	}
+
+	tools := []ToolDefinition{}
+	for _, name := range names {
+		found := false
+		for _, tool := range available {
+			if tool.Name == name {
+				tools = append(tools, tool)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("tool %q is not available to sub-agents, choose from: %s", name, strings.Join(availableNames, ", "))
+		}
+	}
+	return tools, nil
+}
+
+// completeTask runs a sub-agent until it answers the prompt. Once it reaches
+// the configured turn or token limit it is asked for a summary instead, in
+// one last response that doesn't count towards the limits. It returns the
+// answer and the number of responses generated.
+func (a *Agent) completeTask(ctx context.Context, prompt string) (string, int, error) {
+	a.appendMessage(anthropic.NewUserMessage(anthropic.NewTextBlock(prompt)))
+	for turns := 0; ; turns++ {
+		limit := ""
+		if turns >= a.config.TaskMaxTurns {
+			limit = "turn"
+		} else if a.usage.SessionUsage().Total() >= a.config.TaskMaxTokens {
+			limit = "token"
+		}
+		if limit != "" {
+			summary, err := a.summarizeTask(ctx, limit)
+			return summary, turns + 1, err
+		}
+
+		needsReply, err := a.step(ctx)
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return "", turns + 1, err
+		}
+		if !needsReply {
+			return a.lastResponseText(), turns + 1, nil
+		}
+	}
+}
+
+// summarizeTask asks a sub-agent that was stopped by a limit to wrap up. The
+// conversation ends with the results of its last tool calls, which the
+// request is added to.
+func (a *Agent) summarizeTask(ctx context.Context, limit string) (string, error) {
+	last := &a.conversation[len(a.conversation)-1]
+	last.Content = append(last.Content, anthropic.NewTextBlock(fmt.Sprintf(taskLimitPrompt, limit)))
+
+	message, _, err := a.completeResponse(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Tool calls made regardless are ignored
+	a.conversation = append(a.conversation, message)
+	return a.lastResponseText(), nil
+}
+
+// printNested prints text to out, indented under a sub-agent's label
+func printNested(out io.Writer, label, text string) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		fmt.Fprintf(out, "    \u001b[90m[%s]\u001b[0m %s\n", label, line)
+	}
+}
+
+// nestedStreamHandler shows a sub-agent's progress indented under its label.
+// Sub-agents may run concurrently, so blocks are printed once they are
+// complete rather than token by token.
+func nestedStreamHandler(out io.Writer, label string) StreamHandler {
+	return func(event anthropic.MessageStreamEventUnion, message *anthropic.Message) {
+		if event.Type != "content_block_stop" || len(message.Content) == 0 {
+			return
+		}
+		content := message.Content[len(message.Content)-1]
+		switch content.Type {
+		case "text":
+			printNested(out, label, "\u001b[93mClaude\u001b[0m: "+content.Text)
+		case "thinking", "redacted_thinking":
+			printNested(out, label, "\u001b[90mthinking...\u001b[0m")
+		case "tool_use":
+			printNested(out, label, fmt.Sprintf("\u001b[92mtool\u001b[0m: %s(%s)", content.Name, content.Input))
+		}
+	}
+}
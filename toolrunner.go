@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// ToolConcurrency describes what a tool touches, which decides whether it may
+// run at the same time as the other tool calls of a response.
+type ToolConcurrency int
+
+const (
+	// ConcurrencyExclusive tools run on their own, after every earlier call
+	// and before every later one. This is the zero value, so tools that don't
+	// say otherwise (e.g. dynamic tools) are treated as unsafe to overlap.
+	ConcurrencyExclusive ToolConcurrency = iota
+	// ConcurrencyReadOnly tools may read anything but never modify files
+	ConcurrencyReadOnly
+	// ConcurrencyReadsPath tools only read the file named by their "path" input
+	ConcurrencyReadsPath
+	// ConcurrencyWritesPath tools only modify the file named by their "path" input
+	ConcurrencyWritesPath
+)
+
+// toolCall is a single tool_use block scheduled for execution
+type toolCall struct {
+	id          string
+	name        string
+	input       json.RawMessage
+	concurrency ToolConcurrency
+	path        string
+	// rejection is returned instead of running the tool, e.g. for a
+	// mutating tool in plan mode
+	rejection string
+	done      chan struct{}
+}
+
+// conflictsWith reports whether two calls have to run in their original
+// order rather than at the same time.
+func (c *toolCall) conflictsWith(other *toolCall) bool {
+	if c.concurrency == ConcurrencyExclusive || other.concurrency == ConcurrencyExclusive {
+		return true
+	}
+	if c.concurrency != ConcurrencyWritesPath && other.concurrency != ConcurrencyWritesPath {
+		// Reads never conflict with each other
+		return false
+	}
+	if c.concurrency == ConcurrencyReadOnly || other.concurrency == ConcurrencyReadOnly {
+		// A write may affect anything an unscoped read looks at
+		return true
+	}
+	return c.path == other.path
+}
+
+// executeTools runs the tool_use blocks of a response and returns their
+// results in the original block order. Calls that don't conflict run in
+// parallel, limited to the configured number of workers; conflicting calls
+// wait for the earlier ones to finish.
+func (a *Agent) executeTools(ctx context.Context, toolUses []*anthropic.ToolUseBlockParam) []anthropic.ContentBlockParamUnion {
+	calls := make([]*toolCall, len(toolUses))
+	for i, toolUse := range toolUses {
+		input, _ := toolUse.Input.(json.RawMessage)
+		call := &toolCall{
+			id:    toolUse.ID,
+			name:  toolUse.Name,
+			input: input,
+			done:  make(chan struct{}),
+		}
+		if tool, ok := a.findTool(toolUse.Name); ok {
+			call.concurrency = tool.Concurrency
+		} else {
+			// Unknown tools fail straight away without touching anything
+			call.concurrency = ConcurrencyReadOnly
+		}
+		if call.concurrency == ConcurrencyReadsPath || call.concurrency == ConcurrencyWritesPath {
+			call.path = toolInputPath(input)
+		}
+		call.rejection = a.planModeRejection(toolUse.Name)
+		calls[i] = call
+	}
+
+	workers := a.config.maxParallelTools()
+	semaphore := make(chan struct{}, workers)
+	results := make([]anthropic.ContentBlockParamUnion, len(calls))
+	var wg sync.WaitGroup
+
+	for i, call := range calls {
+		// Earlier calls this one has to wait for
+		var dependencies []*toolCall
+		for _, earlier := range calls[:i] {
+			if call.conflictsWith(earlier) {
+				dependencies = append(dependencies, earlier)
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, call *toolCall) {
+			defer wg.Done()
+			defer close(call.done)
+
+			for _, dependency := range dependencies {
+				<-dependency.done
+			}
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			// Every tool_use needs a result, even once interrupted
+			if ctx.Err() != nil {
+				results[i] = anthropic.NewToolResultBlock(call.id, interruptedToolResult, true)
+				return
+			}
+			if call.rejection != "" {
+				results[i] = anthropic.NewToolResultBlock(call.id, call.rejection, true)
+				return
+			}
+			results[i] = a.executeTool(ctx, call.id, call.name, call.input)
+		}(i, call)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// findTool looks up one of the tools currently offered to the model by name
+func (a *Agent) findTool(name string) (ToolDefinition, bool) {
+	for _, tool := range a.activeTools() {
+		if tool.Name == name {
+			return tool, true
+		}
+	}
+	return ToolDefinition{}, false
+}
+
+// toolInputPath extracts the cleaned "path" field of a tool's input
+func toolInputPath(input json.RawMessage) string {
+	var pathInput struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(input, &pathInput); err != nil || pathInput.Path == "" {
+		return ""
+	}
+	return filepath.Clean(pathInput.Path)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+var builtinTools = []ToolDefinition{ReadFileDefinition, ListFilesDefinition, EditFileDefinition, MultiEditDefinition, ApplyPatchDefinition, GrepDefinition, ExecuteCommandDefinition}
+
+func TestReadFileTool(t *testing.T) {
+	useWorkspace(t, map[string]string{"notes.txt": "remember the milk\n"})
+
+	runScript(t, builtinTools, "What do my notes say?",
+		Turn{Calls: []Call{
+			{"read_file", map[string]any{"path": "notes.txt"}},
+			{"read_file", map[string]any{"path": "missing.txt"}},
+			{"read_file", json.RawMessage(`{"path":42}`)},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "remember the milk"},
+				{Contains: "no such file or directory", IsError: true},
+				{Contains: "cannot unmarshal", IsError: true},
+			},
+			Text: "They say to remember the milk.",
+		},
+	)
+}
+
+func TestReadFileRanges(t *testing.T) {
+	var lines, wide strings.Builder
+	for i := 1; i <= 3000; i++ {
+		fmt.Fprintf(&lines, "line %d\n", i)
+	}
+	for i := 1; i <= 1000; i++ {
+		fmt.Fprintf(&wide, "%-199d\n", i)
+	}
+	useWorkspace(t, map[string]string{
+		"lines.txt": lines.String(),
+		"wide.txt":  wide.String(),
+		"long.txt":  strings.Repeat("x", 200*1024),
+		"dir/a.txt": "a",
+		"empty.txt": "",
+		"small.txt": "one\ntwo",
+	})
+
+	runScript(t, builtinTools, "Read the big files",
+		Turn{Calls: []Call{
+			{"read_file", map[string]any{"path": "lines.txt"}},
+			{"read_file", map[string]any{"path": "lines.txt", "offset": 2999, "line_numbers": true}},
+			{"read_file", map[string]any{"path": "lines.txt", "offset": 10, "limit": 2}},
+			{"read_file", map[string]any{"path": "wide.txt"}},
+			{"read_file", map[string]any{"path": "long.txt"}},
+			{"read_file", map[string]any{"path": "small.txt", "line_numbers": true}},
+			{"read_file", map[string]any{"path": "empty.txt"}},
+			{"read_file", map[string]any{"path": "dir"}},
+			{"read_file", map[string]any{"path": "lines.txt", "offset": 5000}},
+			{"read_file", map[string]any{"path": "lines.txt", "limit": -1}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "line 2000\n\n[Showing lines 1-2000 of 3000. Use offset 2001 to read on.]"},
+				{Contains: "  2999\tline 2999\n  3000\tline 3000\n\n[Showing lines 2999-3000 of 3000.]"},
+				{Contains: "line 10\nline 11\n\n[Showing lines 10-11 of 3000. Use offset 12 to read on.]"},
+				{Contains: "[Showing lines 1-512 of 1000, cut short to stay within 102400 bytes. Use offset 513 to read on.]"},
+				{Contains: "[Line 1 of 1 is longer than 102400 bytes and was cut off."},
+				{Contains: "     1\tone\n     2\ttwo\n"},
+				{},
+				{Contains: "dir is a directory, not a file; use list_files", IsError: true},
+				{Contains: "offset 5000 is past the end of the file, which has 3000 lines", IsError: true},
+				{Contains: "offset and limit cannot be negative", IsError: true},
+			},
+			Text: "They are large.",
+		},
+	)
+}
+
+func TestReadFileEncodings(t *testing.T) {
+	useWorkspace(t, map[string]string{
+		"app":        "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00",
+		"utf16.txt":  "\xff\xfeh\x00\xe9\x00\n\x00",
+		"latin1.txt": "caf\xe9\n",
+		"bom.txt":    "\xef\xbb\xbfplain\n",
+	})
+
+	runScript(t, builtinTools, "Read and fix the files",
+		Turn{Calls: []Call{
+			{"read_file", map[string]any{"path": "app"}},
+			{"read_file", map[string]any{"path": "utf16.txt"}},
+			{"read_file", map[string]any{"path": "latin1.txt"}},
+			{"read_file", map[string]any{"path": "bom.txt"}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "app is a binary file and wasn't read: 18 bytes, application/octet-stream, ELF executable.\nFirst bytes: 7f 45 4c 46"},
+				{Contains: "hé\n\n[The file is encoded as UTF-16LE with BOM and was converted to UTF-8."},
+				{Contains: "café\n\n[The file is encoded as windows-1252 and was converted to UTF-8."},
+				{Contains: "plain\n\n[The file is encoded as UTF-8 with BOM"},
+			},
+			Calls: []Call{
+				{"edit_file", map[string]any{"path": "utf16.txt", "old_str": "hé", "new_str": "hé€"}},
+				{"edit_file", map[string]any{"path": "latin1.txt", "old_str": "café", "new_str": "déjà vu"}},
+				{"edit_file", map[string]any{"path": "latin1.txt", "old_str": "vu", "new_str": "✓"}},
+				{"edit_file", map[string]any{"path": "app", "old_str": "ELF", "new_str": "elf"}},
+			},
+		},
+		Turn{
+			Expect: []Result{
+				{Contains: "OK"},
+				{Contains: "OK"},
+				{Contains: "encoded as windows-1252, which can't represent the new text", IsError: true},
+				{Contains: "app is a binary file and can't be edited", IsError: true},
+			},
+			Text: "Done.",
+		},
+	)
+	assertFile(t, "utf16.txt", "\xff\xfeh\x00\xe9\x00\xac\x20\n\x00")
+	assertFile(t, "latin1.txt", "d\xe9j\xe0 vu\n")
+}
+
+func TestListFilesTool(t *testing.T) {
+	useWorkspace(t, map[string]string{
+		"main.go":                   "package main\n",
+		"docs/guide.md":             "# Guide\n",
+		".env":                      "SECRET=1\n",
+		"node_modules/pkg/index.js": "",
+	})
+
+	runScript(t, builtinTools, "What files are there?",
+		Turn{Calls: []Call{
+			{"list_files", nil},
+			{"list_files", map[string]any{"path": "docs"}},
+			{"list_files", map[string]any{"include_hidden": true, "exclude": []string{"docs"}}},
+			{"list_files", map[string]any{"path": "nowhere"}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: `["docs/","docs/guide.md","main.go"]`},
+				{Contains: `["guide.md"]`},
+				{Contains: `[".env","main.go"]`},
+				{Contains: "no such file or directory", IsError: true},
+			},
+			Text: "A Go program and its docs.",
+		},
+	)
+}
+
+func TestEditFileTool(t *testing.T) {
+	useWorkspace(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"})
+
+	runScript(t, builtinTools, "Add a greeting",
+		Turn{Calls: []Call{
+			{"edit_file", map[string]any{"path": "main.go", "old_str": "func main() {}", "new_str": "func main() { greet() }"}},
+			{"edit_file", map[string]any{"path": "internal/greet.go", "old_str": "", "new_str": "package main\n\nfunc greet() {}\n"}},
+		}},
+		Turn{
+			Expect: []Result{{Contains: "OK"}, {Contains: "Successfully created file internal/greet.go"}},
+			Calls: []Call{
+				{"edit_file", map[string]any{"path": "main.go", "old_str": "func main() {}", "new_str": "func main() {}"}},
+				{"edit_file", map[string]any{"path": "main.go", "old_str": "func helper()", "new_str": "func other()"}},
+				{"edit_file", map[string]any{"path": "missing.go", "old_str": "x", "new_str": "y"}},
+			},
+		},
+		Turn{
+			Expect: []Result{
+				{Contains: "invalid input parameters", IsError: true},
+				{Contains: "old_str not found in file", IsError: true},
+				{Contains: "no such file or directory", IsError: true},
+			},
+			Text: "Done.",
+		},
+	)
+
+	assertFile(t, "main.go", "package main\n\nfunc main() { greet() }\n")
+	assertFile(t, "internal/greet.go", "package main\n\nfunc greet() {}\n")
+}
+
+func TestEditFileUniqueMatches(t *testing.T) {
+	source := "package main\n\nfunc main() {\n\tlog(\"start\")\n\tif ok {\n\t\tlog(\"done\")\n\t}\n\tlog(\"start\")\n}\n"
+	useWorkspace(t, map[string]string{"main.go": source, "empty.txt": ""})
+
+	runScript(t, builtinTools, "Rename the log calls",
+		Turn{Calls: []Call{
+			{"edit_file", map[string]any{"path": "main.go", "old_str": `log("start")`, "new_str": `print("start")`}},
+			{"edit_file", map[string]any{"path": "main.go", "old_str": "if  ok {\n  log(\"done\")", "new_str": "if ok {\n\t\tprint(\"done\")"}},
+			{"edit_file", map[string]any{"path": "main.go", "old_str": "nothing like it", "new_str": "x"}},
+			{"edit_file", map[string]any{"path": "main.go", "old_str": "", "new_str": "x"}},
+			{"edit_file", map[string]any{"path": "empty.txt", "old_str": "", "new_str": "filled\n"}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "old_str matches 2 times, at lines 4 and 8. Include more of the surrounding text to make it unique, or set replace_all", IsError: true},
+				{Contains: "old_str not found in file. The closest matches, ignoring whitespace and indentation, are:\n\nLines 5-6:\n     5\t\tif ok {\n     6\t\t\tlog(\"done\")\n\nCopy the text exactly", IsError: true},
+				{Contains: "old_str not found in file", IsError: true},
+				{Contains: "old_str cannot be empty unless the file is being created", IsError: true},
+				{Contains: "OK"},
+			},
+			Calls: []Call{{"edit_file", map[string]any{"path": "main.go", "old_str": "log(", "new_str": "print(", "replace_all": true}}},
+		},
+		Turn{Expect: []Result{{Contains: "OK, replaced 3 occurrences"}}, Text: "Done."},
+	)
+
+	assertFile(t, "main.go", strings.ReplaceAll(source, "log(", "print("))
+	assertFile(t, "empty.txt", "filled\n")
+}
+
+func TestMultiEditTool(t *testing.T) {
+	source := "package main\n\nfunc main() {\n\tlog(\"start\")\n\tlog(\"done\")\n}\n"
+	useWorkspace(t, map[string]string{"main.go": source, "empty.go": ""})
+
+	runScript(t, builtinTools, "Refactor main",
+		Turn{Calls: []Call{
+			{"multi_edit", map[string]any{"path": "main.go", "edits": []map[string]any{
+				{"old_str": "func main()", "new_str": "func run()"},
+				{"old_str": "log(", "new_str": "print("},
+				{"old_str": "func run()", "new_str": "func start()"},
+			}}},
+			{"multi_edit", map[string]any{"path": "main.go", "edits": []map[string]any{
+				{"old_str": "func main()", "new_str": "func run()"},
+				{"old_str": "func main()", "new_str": "func start()"},
+			}}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: "edit 2 failed, so the file was left unchanged: old_str matches 2 times, at lines 4 and 5", IsError: true},
+				{Contains: "edit 2 failed, so the file was left unchanged: old_str not found in file", IsError: true},
+			},
+			Calls: []Call{
+				{"multi_edit", map[string]any{"path": "main.go", "edits": []map[string]any{
+					{"old_str": "func main()", "new_str": "func run()"},
+					{"old_str": "log(", "new_str": "print(", "replace_all": true},
+				}}},
+				{"multi_edit", map[string]any{"path": "cmd/tool.go", "edits": []map[string]any{
+					{"old_str": "", "new_str": "package main\n\nfunc tool() {}\n"},
+					{"old_str": "tool", "new_str": "helper"},
+				}}},
+				{"multi_edit", map[string]any{"path": "main.go", "edits": []map[string]any{}}},
+				{"multi_edit", map[string]any{"path": "empty.go", "edits": []map[string]any{
+					{"old_str": "", "new_str": "package main\n\nfunc empty() {}\n"},
+					{"old_str": "empty", "new_str": "filled"},
+				}}},
+			},
+		},
+		Turn{
+			Expect: []Result{
+				{Contains: "OK, applied 2 edits with 3 replacements"},
+				{Contains: "Successfully created file cmd/tool.go with 2 edits applied"},
+				{Contains: "a path and at least one edit are required", IsError: true},
+				{Contains: "OK, applied 2 edits with 2 replacements"},
+			},
+			Text: "Done.",
+		},
+	)
+
+	assertFile(t, "main.go", "package main\n\nfunc run() {\n\tprint(\"start\")\n\tprint(\"done\")\n}\n")
+	assertFile(t, "cmd/tool.go", "package main\n\nfunc helper() {}\n")
+	assertFile(t, "empty.go", "package main\n\nfunc filled() {}\n")
+}
+
+func TestGrepTool(t *testing.T) {
+	useWorkspace(t, map[string]string{
+		"main.go":       "package main\n\n// TODO: handle errors\nfunc main() {}\n",
+		"util/util.go":  "package util\n// TODO: tests\n",
+		".hidden/todo":  "TODO: hidden\n",
+		"binary.dat":    "\x00TODO",
+		"vendor/lib.go": "// TODO: vendored\n",
+	})
+
+	runScript(t, builtinTools, "Find the TODOs",
+		Turn{Calls: []Call{
+			{"grep", map[string]any{"pattern": "TODO"}},
+			{"grep", map[string]any{"pattern": "TODO", "path": "util"}},
+			{"grep", map[string]any{"pattern": "FIXME"}},
+			{"grep", map[string]any{"pattern": "("}},
+			{"grep", map[string]any{"pattern": ""}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: `"file": "main.go",
+    "line": 3,
+    "content": "// TODO: handle errors"
+  },
+  {
+    "file": "util/util.go",
+    "line": 2,
+    "content": "// TODO: tests"
+  }
+]`},
+				{Contains: `"file": "util.go"`},
+				{Contains: "No matches found."},
+				{Contains: "invalid regular expression", IsError: true},
+				{Contains: "pattern cannot be empty", IsError: true},
+			},
+			Text: "There are two TODOs.",
+		},
+	)
+}
+
+func TestExecuteTool(t *testing.T) {
+	useWorkspace(t, nil)
+
+	runScript(t, builtinTools, "Run some commands",
+		Turn{Calls: []Call{
+			{"execute", map[string]any{"command": "echo hello"}},
+			{"execute", map[string]any{"command": "echo oops >&2; exit 3"}},
+			{"execute", map[string]any{"command": "sleep 5", "timeout": 1}},
+			{"execute", map[string]any{"command": ""}},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: `"stdout": "hello\n",
+  "stderr": "",
+  "exit_code": 0`},
+				{Contains: `"stderr": "oops\n",
+  "exit_code": 3`},
+				{Contains: "command timed out after 1 seconds", IsError: true},
+				{Contains: "command cannot be empty", IsError: true},
+			},
+			Text: "All done.",
+		},
+	)
+}
+
+func TestDynamicTools(t *testing.T) {
+	useWorkspace(t, map[string]string{"tools_config.json": `{
+  "tools": [
+    {
+      "name": "greet",
+      "description": "Greets someone",
+      "command": "echo Hello, {{.name}}{{.punctuation}}",
+      "parameters": [
+        {"name": "name", "description": "Who to greet", "required": true},
+        {"name": "punctuation", "description": "How to end", "default": "!"}
+      ]
+    },
+    {
+      "name": "broken",
+      "description": "Has an invalid template",
+      "command": "echo {{.oops"
+    }
+  ]
+}`})
+	tools, err := LoadDynamicTools(io.Discard, "tools_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runScript(t, tools, "Say hello",
+		Turn{Calls: []Call{
+			{"greet", map[string]any{"name": "Ada"}},
+			{"greet", map[string]any{"name": "Ada", "punctuation": "?"}},
+			{"greet", nil},
+			{"broken", nil},
+			{"no_such_tool", nil},
+		}},
+		Turn{
+			Expect: []Result{
+				{Contains: `"stdout": "Hello, Ada!\n"`},
+				{Contains: `"stdout": "Hello, Ada?\n"`},
+				{Contains: "missing required parameter: name", IsError: true},
+				{Contains: "invalid command template", IsError: true},
+				{Contains: "tool not found", IsError: true},
+			},
+			Text: "Hello, Ada!",
+		},
+	)
+}
+
+func TestTaskTool(t *testing.T) {
+	useWorkspace(t, map[string]string{"main.go": "package main\n\n// TODO: handle errors\nfunc main() {}\n"})
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{
+			{"task", map[string]any{"description": "find TODOs", "prompt": "List the TODO comments"}},
+			{"task", map[string]any{"prompt": "Fix the TODOs", "tools": []string{"edit_file"}}},
+			{"task", map[string]any{"description": "nothing"}},
+		}},
+		// The sub-agent's conversation
+		Turn{Calls: []Call{{"grep", map[string]any{"pattern": "TODO"}}}},
+		Turn{
+			Expect: []Result{{Contains: "handle errors"}},
+			Text:   "One TODO at main.go:3 about handling errors.",
+		},
+		Turn{
+			Expect: []Result{
+				{Contains: "One TODO at main.go:3 about handling errors."},
+				{Contains: `tool "edit_file" is not available to sub-agents, choose from: read_file, list_files, grep`, IsError: true},
+				{Contains: "prompt cannot be empty", IsError: true},
+			},
+			Text: "There is one TODO.",
+		},
+	)
+	agent := newScriptedAgent(provider, builtinTools, "Where are the TODOs?")
+	agent.EnableTasks()
+	runAgent(t, agent)
+
+	sub := provider.requests[1]
+	if !strings.Contains(sub.System, "sub-agent") {
+		t.Errorf("sub-agent system prompt = %q", sub.System)
+	}
+	if len(sub.Messages) != 1 || !strings.Contains(renderTranscript(sub.Messages, 0), "List the TODO comments") {
+		t.Errorf("sub-agent didn't start a fresh conversation: %q", renderTranscript(sub.Messages, 0))
+	}
+	names := []string{}
+	for _, tool := range sub.Tools {
+		names = append(names, tool.Name)
+	}
+	if got := strings.Join(names, ","); got != "read_file,list_files,grep" {
+		t.Errorf("sub-agent tools = %s, want the read-only tools", got)
+	}
+	// Only the summary makes it into the main conversation
+	if transcript := renderTranscript(agent.conversation, 0); strings.Contains(transcript, `"content": "// TODO: handle errors"`) {
+		t.Errorf("sub-agent tool output leaked into the conversation:\n%s", transcript)
+	}
+}
+
+func TestTaskToolTurnLimit(t *testing.T) {
+	useWorkspace(t, map[string]string{"notes.txt": "remember the milk\n"})
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{{"task", map[string]any{"prompt": "Read every file", "tools": []string{"list_files", "read_file"}}}}},
+		Turn{Calls: []Call{{"list_files", nil}}},
+		// Out of turns, so the sub-agent is asked to wrap up
+		Turn{
+			Expect: []Result{{Contains: "notes.txt"}},
+			Text:   "Only got as far as listing notes.txt.",
+		},
+		Turn{
+			Expect: []Result{{Contains: "Only got as far as listing notes.txt."}},
+			Text:   "The sub-agent ran out of turns.",
+		},
+	)
+	agent := newScriptedAgent(provider, builtinTools, "Read everything")
+	agent.config.TaskMaxTurns = 1
+	agent.EnableTasks()
+	runAgent(t, agent)
+
+	if transcript := renderTranscript(provider.requests[2].Messages, 0); !strings.Contains(transcript, "reached the turn limit") {
+		t.Errorf("sub-agent wasn't told about the limit:\n%s", transcript)
+	}
+}
+
+func TestTaskToolBudget(t *testing.T) {
+	useWorkspace(t, map[string]string{"log.txt": strings.Repeat("GET /index.html 200 0.013s from 10.0.0.1 with no referrer\n", 1000)})
+
+	provider := NewScriptedProvider(t,
+		Turn{Calls: []Call{{"task", map[string]any{"prompt": "Summarize the log", "tools": []string{"read_file"}}}}},
+		Turn{Calls: []Call{{"read_file", map[string]any{"path": "log.txt"}}}},
+		// Sending the log back would take the session over its budget
+		Turn{
+			Expect: []Result{{Contains: "task failed: session budget reached", IsError: true}},
+			Text:   "The log is too big to summarize within the budget.",
+		},
+	)
+	agent := newScriptedAgent(provider, builtinTools, "What's in the log?")
+	agent.usage = NewUsageTracker(nil, 0.01)
+	agent.EnableTasks()
+	runAgent(t, agent)
+
+	if len(provider.requests) != 3 {
+		t.Errorf("sent %d requests, want the sub-agent to stop before reading the log back", len(provider.requests))
+	}
+}
+
+func TestLoadDynamicToolsErrors(t *testing.T) {
+	useWorkspace(t, map[string]string{"invalid.json": "{"})
+
+	if _, err := LoadDynamicTools(io.Discard, "missing.json"); err == nil {
+		t.Error("expected an error for a missing config")
+	}
+	if _, err := LoadDynamicTools(io.Discard, "invalid.json"); err == nil {
+		t.Error("expected an error for an invalid config")
+	}
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != want {
+		t.Errorf("%s = %q, want %q", path, content, want)
+	}
+}